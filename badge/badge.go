@@ -2,30 +2,43 @@ package badge
 
 /***
 * This file implements Badger structure.
-* `Badger` get test result from DB, and returns appropriate URL to generate a badge at shields.io.
+* `Badger` get test result from result store, and renders a badge in SVG,
+* or returns appropriate URL to generate a badge at shields.io.
 ***/
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/smallkirby/skbctf-status/checker"
 	"github.com/xeonx/timeago"
 )
 
+/***
+* @bars: cache of uptime bars of status page
+***/
 type Badger struct {
-	db *sqlx.DB
+	store checker.ResultStore
+	bars  *barCache
 }
 
 func NewBadger(dbuser string, dbpass string, dbhost string, dbname string) (*Badger, error) {
-	if db, err := checker.Connect(dbuser, dbpass, dbhost, dbname); err != nil {
+	if store, err := checker.NewMysqlStore(dbuser, dbpass, dbhost, dbname); err != nil {
 		return nil, err
 	} else {
-		return &Badger{db: db}, nil
+		return NewBadgerWithStore(store), nil
 	}
 }
 
+func NewBadgerWithStore(store checker.ResultStore) *Badger {
+	return &Badger{store: store, bars: &barCache{entries: make(map[int]cachedBars)}}
+}
+
+func (bd Badger) Close() error {
+	return bd.store.Close()
+}
+
 func toShieldsString(s string) string {
 	/*
 
@@ -46,15 +59,20 @@ func toShieldsUrl(label string, message string, color string) string {
 	return fmt.Sprintf("https://img.shields.io/badge/%s", value)
 }
 
-// https://img.shields.io/badge/<LABEL>-<MESSAGE>-<COLOR>
-func (bd Badger) GetBadge(challid int) (string, error) {
-	results, err := checker.FetchResult(bd.db, challid, 1)
+// Error returned when the challenge has no test result.
+var ErrStatusNotFound = errors.New("status not found")
+
+/***
+* Get label, message and color of the badge of the latest test result.
+***/
+func (bd Badger) badgeContent(challid int) (string, string, string, error) {
+	results, err := bd.store.FetchResult(challid, 1)
 	if err != nil {
-		return "", err
+		return "", "", "", err
 	}
 
 	if len(results) != 1 {
-		return "", fmt.Errorf("Status for %v not found.", challid)
+		return "", "", "", fmt.Errorf("Status for %v not found: %w", challid, ErrStatusNotFound)
 	}
 	result := results[0]
 
@@ -62,7 +80,68 @@ func (bd Badger) GetBadge(challid int) (string, error) {
 	label := status.ToMessage()
 	message := timeago.English.Format(result.Timestamp)
 	color := status.ToColor()
+	return label, message, color, nil
+}
+
+// https://img.shields.io/badge/<LABEL>-<MESSAGE>-<COLOR>
+func (bd Badger) GetBadge(challid int) (string, error) {
+	label, message, color, err := bd.badgeContent(challid)
+	if err != nil {
+		return "", err
+	}
 	url := toShieldsUrl(label, message, color)
 
 	return url, nil
 }
+
+/***
+* Render badge of the latest test result in SVG of the style.
+***/
+func (bd Badger) GetBadgeSvg(challid int, style string) ([]byte, error) {
+	label, message, color, err := bd.badgeContent(challid)
+	if err != nil {
+		return nil, err
+	}
+	return RenderSvg(label, message, color, style)
+}
+
+/***
+* Render badge shown when status can't be fetched.
+***/
+func ErrorBadgeSvg(message string, style string) ([]byte, error) {
+	return RenderSvg("error", message, "e05d44", style)
+}
+
+// Seconds shields.io caches endpoint badges. shields.io doesn't accept less than 300.
+const endpointCacheSeconds = 300
+
+/***
+* Badge in shields.io endpoint schema.
+* cf. https://shields.io/badges/endpoint-badge
+***/
+type Endpoint struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+	IsError       bool   `json:"isError,omitempty"`
+	CacheSeconds  int    `json:"cacheSeconds"`
+}
+
+/***
+* Get badge of the latest test result in shields.io endpoint schema.
+***/
+func (bd Badger) GetBadgeEndpoint(challid int) (Endpoint, error) {
+	label, message, color, err := bd.badgeContent(challid)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	return Endpoint{SchemaVersion: 1, Label: label, Message: message, Color: color, CacheSeconds: endpointCacheSeconds}, nil
+}
+
+/***
+* Badge in shields.io endpoint schema shown when status can't be fetched.
+***/
+func ErrorBadgeEndpoint(message string) Endpoint {
+	return Endpoint{SchemaVersion: 1, Label: "error", Message: message, Color: "e05d44", IsError: true, CacheSeconds: endpointCacheSeconds}
+}
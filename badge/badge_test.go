@@ -1,7 +1,11 @@
 package badge
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/smallkirby/skbctf-status/checker"
@@ -44,3 +48,95 @@ func TestBadgeUrl(t *testing.T) {
 
 	fmt.Printf("Shields URL: %s\n", url)
 }
+
+func TestShieldsUrlOfResults(t *testing.T) {
+	results := map[checker.TestResult]string{
+		checker.TestSuccess:      "https://img.shields.io/badge/Success-1 minute ago-33FF99",
+		checker.TestBuildFailure: "https://img.shields.io/badge/Build Failure-1 minute ago-FF8000",
+		checker.TestInfraError:   "https://img.shields.io/badge/Infra Error-1 minute ago-B0A000",
+	}
+
+	for result, expected := range results {
+		url := toShieldsUrl(result.ToMessage(), "1 minute ago", result.ToColor())
+		if url != expected {
+			t.Errorf("Unexpected URL for %v: %s", result, url)
+		}
+	}
+}
+
+func TestBadgeUrlSqlite(t *testing.T) {
+	store, err := checker.OpenStore("sqlite", filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	badger := NewBadgerWithStore(store)
+	defer badger.Close()
+
+	if _, err := badger.GetBadge(1); err == nil {
+		t.Error("Badge of challenge without result must fail.")
+	}
+
+	if err := store.RecordResult(Challenge{Name: "TestBadgeUrlSqlite Challenge", Id: 1, Result: checker.TestWrongFlag}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	url, err := badger.GetBadge(1)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasPrefix(url, "https://img.shields.io/badge/Wrong Flag-") || !strings.HasSuffix(url, "-CC3366") {
+		t.Errorf("Unexpected URL: %s", url)
+	}
+}
+
+func TestBadgeSvgSqlite(t *testing.T) {
+	store, err := checker.OpenStore("sqlite", filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	badger := NewBadgerWithStore(store)
+	defer badger.Close()
+
+	if _, err := badger.GetBadgeSvg(1, "flat"); !errors.Is(err, ErrStatusNotFound) {
+		t.Errorf("Badge of challenge without result must be not found: %v", err)
+	}
+
+	if err := store.RecordResult(Challenge{Name: "TestBadgeSvgSqlite Challenge", Id: 1, Result: checker.TestTimeout}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	svg, err := badger.GetBadgeSvg(1, "flat-square")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(string(svg), ">Timeout<") || !strings.Contains(string(svg), "#6600CC") {
+		t.Errorf("Unexpected badge: %s", svg)
+	}
+}
+
+func TestBadgeEndpointSqlite(t *testing.T) {
+	store, err := checker.OpenStore("sqlite", filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	badger := NewBadgerWithStore(store)
+	defer badger.Close()
+
+	if _, err := badger.GetBadgeEndpoint(1); !errors.Is(err, ErrStatusNotFound) {
+		t.Errorf("Badge of challenge without result must be not found: %v", err)
+	}
+
+	if err := store.RecordResult(Challenge{Name: "TestBadgeEndpointSqlite Challenge", Id: 1, Result: checker.TestSuccess}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	endpoint, err := badger.GetBadgeEndpoint(1)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	encoded, err := json.Marshal(endpoint)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := `{"schemaVersion":1,"label":"Success","message":"` + endpoint.Message + `","color":"33FF99","cacheSeconds":300}`
+	if string(encoded) != expected || len(endpoint.Message) == 0 {
+		t.Errorf("Unexpected endpoint badge: %s", encoded)
+	}
+}
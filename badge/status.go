@@ -0,0 +1,244 @@
+package badge
+
+/***
+* This file implements status page of all challenges.
+* Page is rendered from `templates/status.html` in the server side, and needs no JavaScript.
+* Challenges are grouped by category recorded with their latest results.
+* Uptime bars need results of 7 days for each challenge, so they're cached until the challenge gets a new result,
+* or for `barCacheTtl` at most so that segments follow the current time.
+***/
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smallkirby/skbctf-status/checker"
+	"github.com/xeonx/timeago"
+)
+
+//go:embed templates/status.html
+var templateFiles embed.FS
+
+var statusTemplate = template.Must(template.New("status.html").Funcs(template.FuncMap{
+	"percent": func(p float64) string { return fmt.Sprintf("%.2f%%", p) },
+	"clock":   func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 MST") },
+}).ParseFS(templateFiles, "templates/status.html"))
+
+// Category of challenges recorded without category.
+const uncategorized = "uncategorized"
+
+/***
+* Window and # of segments of uptime bar.
+***/
+type barSpec struct {
+	label    string
+	window   time.Duration
+	segments int
+}
+
+var uptimeBars = []barSpec{
+	{label: "24h", window: 24 * time.Hour, segments: 24},
+	{label: "7d", window: 7 * 24 * time.Hour, segments: 28},
+}
+
+/***
+* A part of uptime bar.
+* @Known: whether any result tells state of the challenge in the segment
+***/
+type BarSegment struct {
+	Since      time.Time
+	Until      time.Time
+	Percentage float64
+	Known      bool
+}
+
+/***
+* Color of segment: green if always up, red if mostly down, and gray if unknown.
+***/
+func (seg BarSegment) Color() string {
+	switch {
+	case !seg.Known:
+		return "#ddd"
+	case seg.Percentage >= 100:
+		return "#33ff99"
+	case seg.Percentage >= 90:
+		return "#ffcc00"
+	default:
+		return "#ff3333"
+	}
+}
+
+/***
+* Uptime of a challenge in a window, split into segments.
+* @Known: whether any result tells state of the challenge in the window. `Percentage` is meaningless if false.
+***/
+type UptimeBar struct {
+	Label      string
+	Percentage float64
+	Known      bool
+	Segments   []BarSegment
+}
+
+/***
+* Status of a challenge shown in status page.
+***/
+type ChallengeStatus struct {
+	checker.DbResult
+	Message     string
+	Color       string
+	LastChecked string
+	Bars        []UptimeBar
+}
+
+/***
+* Challenges of a category.
+***/
+type StatusGroup struct {
+	Category   string
+	Challenges []ChallengeStatus
+}
+
+/***
+* Data of status page.
+* @Healthy: # of challenges whose latest results are successful
+***/
+type StatusPage struct {
+	Generated time.Time
+	Groups    []StatusGroup
+	Healthy   int
+	Total     int
+}
+
+// Max age of cached uptime bars.
+const barCacheTtl = 5 * time.Minute
+
+/***
+* Uptime bars of a challenge.
+* @latest: timestamp of the latest result of the challenge when bars are built
+* @built: `now` bars are built at
+***/
+type cachedBars struct {
+	bars   []UptimeBar
+	latest time.Time
+	built  time.Time
+}
+
+/***
+* Cache of uptime bars of each challenge.
+***/
+type barCache struct {
+	mu      sync.Mutex
+	entries map[int]cachedBars
+}
+
+/***
+* Uptime bars of the challenge whose latest result is `latest`, built or taken from cache.
+***/
+func (bd Badger) uptimeBars(latest checker.DbResult, now time.Time) ([]UptimeBar, error) {
+	bd.bars.mu.Lock()
+	entry, ok := bd.bars.entries[latest.ChallId]
+	bd.bars.mu.Unlock()
+	if ok && entry.latest.Equal(latest.Timestamp) && !now.Before(entry.built) && now.Sub(entry.built) < barCacheTtl {
+		return entry.bars, nil
+	}
+
+	var bars []UptimeBar
+	for _, spec := range uptimeBars {
+		bar, err := bd.uptimeBar(latest.ChallId, spec, now)
+		if err != nil {
+			return nil, err
+		}
+		bars = append(bars, bar)
+	}
+	bd.bars.mu.Lock()
+	bd.bars.entries[latest.ChallId] = cachedBars{bars: bars, latest: latest.Timestamp, built: now}
+	bd.bars.mu.Unlock()
+	return bars, nil
+}
+
+/***
+* Build uptime bar of the challenge in the window before `now`.
+***/
+func (bd Badger) uptimeBar(challid int, spec barSpec, now time.Time) (UptimeBar, error) {
+	availabilities, err := checker.ComputeAvailabilitySegments(bd.store, challid, now.Add(-spec.window), now, spec.segments)
+	if err != nil {
+		return UptimeBar{}, err
+	}
+	bar := UptimeBar{Label: spec.label}
+	var up, known time.Duration
+	for _, availability := range availabilities {
+		bar.Segments = append(bar.Segments, BarSegment{
+			Since:      availability.Since,
+			Until:      availability.Until,
+			Percentage: availability.Percentage(),
+			Known:      availability.Known(),
+		})
+		up += availability.Uptime
+		known += availability.Uptime + availability.Downtime
+	}
+	if known > 0 {
+		bar.Known = true
+		bar.Percentage = float64(up) / float64(known) * 100
+	}
+	return bar, nil
+}
+
+/***
+* Collect status of all challenges which have results.
+***/
+func (bd Badger) GetStatusPage(now time.Time) (StatusPage, error) {
+	page := StatusPage{Generated: now}
+	latest, err := bd.store.FetchLatestResults()
+	if err != nil {
+		return page, err
+	}
+
+	groups := make(map[string][]ChallengeStatus)
+	for _, result := range latest {
+		status := ChallengeStatus{
+			DbResult:    result,
+			Message:     result.Result.ToMessage(),
+			Color:       "#" + result.Result.ToColor(),
+			LastChecked: timeago.English.FormatReference(result.Timestamp, now),
+		}
+		bars, err := bd.uptimeBars(result, now)
+		if err != nil {
+			return page, err
+		}
+		status.Bars = bars
+		if result.Result == checker.TestSuccess || result.Result == checker.TestSuccessWithoutExecution {
+			page.Healthy++
+		}
+		category := strings.TrimSpace(result.Category)
+		if len(category) == 0 {
+			category = uncategorized
+		}
+		groups[category] = append(groups[category], status)
+	}
+	page.Total = len(latest)
+
+	for category, challenges := range groups {
+		page.Groups = append(page.Groups, StatusGroup{Category: category, Challenges: challenges})
+	}
+	// categories in alphabetical order, and uncategorized ones at last
+	sort.Slice(page.Groups, func(i, j int) bool {
+		if (page.Groups[i].Category == uncategorized) != (page.Groups[j].Category == uncategorized) {
+			return page.Groups[j].Category == uncategorized
+		}
+		return page.Groups[i].Category < page.Groups[j].Category
+	})
+	return page, nil
+}
+
+/***
+* Render status page in HTML.
+***/
+func RenderStatusPage(w io.Writer, page StatusPage) error {
+	return statusTemplate.Execute(w, page)
+}
@@ -0,0 +1,135 @@
+package badge
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallkirby/skbctf-status/checker"
+)
+
+func TestStatusPage(t *testing.T) {
+	badger := NewBadgerWithStore(checker.NewMemoryStore())
+	defer badger.Close()
+
+	challs := []Challenge{
+		{Name: "misc<1>", Id: 1, Result: checker.TestSuccess},
+		{Name: "web-1", Id: 2, Category: "web", Result: checker.TestFailure},
+		{Name: "pwn-1", Id: 3, Category: "pwn", Result: checker.TestSuccess},
+		{Name: "pwn-2", Id: 4, Category: "pwn", Result: checker.TestSuccessWithoutExecution},
+	}
+	for _, chall := range challs {
+		if err := badger.store.RecordResult(chall); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	page, err := badger.GetStatusPage(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to collect status: %v", err)
+	}
+	if page.Healthy != 3 || page.Total != 4 || len(page.Groups) != 3 {
+		t.Fatalf("Unexpected status page: %+v", page)
+	}
+	categories := []string{page.Groups[0].Category, page.Groups[1].Category, page.Groups[2].Category}
+	if strings.Join(categories, ",") != "pwn,web,"+uncategorized || len(page.Groups[0].Challenges) != 2 {
+		t.Errorf("Unexpected groups: %v", categories)
+	}
+
+	bars := page.Groups[0].Challenges[0].Bars
+	if len(bars) != 2 || len(bars[0].Segments) != 24 || len(bars[1].Segments) != 28 {
+		t.Fatalf("Unexpected uptime bars: %+v", bars)
+	}
+	last := bars[0].Segments[23]
+	if !last.Known || last.Color() != "#33ff99" || bars[0].Segments[0].Known || !bars[0].Known || bars[0].Percentage != 100 {
+		t.Errorf("Unexpected segments: %+v", bars[0].Segments)
+	}
+
+	var html bytes.Buffer
+	if err := RenderStatusPage(&html, page); err != nil {
+		t.Fatalf("Failed to render status page: %v", err)
+	}
+	if !strings.Contains(html.String(), "misc&lt;1&gt;") || !strings.Contains(html.String(), "3 of 4 challenges are healthy.") {
+		t.Errorf("Unexpected status page:\n%s", html.String())
+	}
+
+	// page without challenges
+	html.Reset()
+	if err := RenderStatusPage(&html, StatusPage{Generated: time.Now()}); err != nil || !strings.Contains(html.String(), "No challenge is checked yet.") {
+		t.Errorf("Unexpected empty status page: %v\n%s", err, html.String())
+	}
+}
+
+func TestStatusPageNoData(t *testing.T) {
+	badger := NewBadgerWithStore(checker.NewMemoryStore())
+	defer badger.Close()
+	if err := badger.store.RecordResult(Challenge{Name: "infra", Id: 1, Result: checker.TestInfraError}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	page, err := badger.GetStatusPage(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to collect status: %v", err)
+	}
+	if bar := page.Groups[0].Challenges[0].Bars[0]; bar.Known {
+		t.Errorf("Bar without known results must be unknown: %+v", bar)
+	}
+
+	var html bytes.Buffer
+	if err := RenderStatusPage(&html, page); err != nil {
+		t.Fatalf("Failed to render status page: %v", err)
+	}
+	if strings.Contains(html.String(), "% uptime") || !strings.Contains(html.String(), `<span class="uptime">no data</span>`) {
+		t.Errorf("Uptime of challenge without known results must be no data:\n%s", html.String())
+	}
+}
+
+/***
+* Store counting queries of results in range, which uptime bars are built from.
+***/
+type countingStore struct {
+	checker.ResultStore
+	range_queries int
+}
+
+func (s *countingStore) FetchResultRange(challid int, since time.Time, until time.Time) ([]checker.DbResult, error) {
+	s.range_queries++
+	return s.ResultStore.FetchResultRange(challid, since, until)
+}
+
+func TestStatusPageBarCache(t *testing.T) {
+	store := &countingStore{ResultStore: checker.NewMemoryStore()}
+	badger := NewBadgerWithStore(store)
+	defer badger.Close()
+	for id := 1; id <= 3; id++ {
+		store.RecordResult(Challenge{Name: "chall", Id: id, Result: checker.TestSuccess})
+	}
+
+	now := time.Now().Add(time.Minute)
+	if _, err := badger.GetStatusPage(now); err != nil {
+		t.Fatalf("Failed to collect status: %v", err)
+	}
+	built := store.range_queries
+	if built != 3*len(uptimeBars) {
+		t.Fatalf("Unexpected # of queries: %d", built)
+	}
+
+	// bars are cached until the challenge gets a new result
+	if _, err := badger.GetStatusPage(now.Add(time.Second)); err != nil || store.range_queries != built {
+		t.Errorf("Bars must be cached: %d queries, %v", store.range_queries, err)
+	}
+	store.RecordResult(Challenge{Name: "chall", Id: 2, Result: checker.TestFailure})
+	page, err := badger.GetStatusPage(now.Add(2 * time.Second))
+	if err != nil || store.range_queries != built+len(uptimeBars) {
+		t.Errorf("Only bars of the challenge with new result must be rebuilt: %d queries, %v", store.range_queries, err)
+	}
+	if last := page.Groups[0].Challenges[1].Bars[0].Segments[23]; last.Percentage == 100 {
+		t.Errorf("Rebuilt bar must reflect the new result: %+v", last)
+	}
+
+	// and expire after TTL
+	if _, err := badger.GetStatusPage(now.Add(barCacheTtl + 2*time.Second)); err != nil || store.range_queries != 2*built+len(uptimeBars) {
+		t.Errorf("Cached bars must expire: %d queries, %v", store.range_queries, err)
+	}
+}
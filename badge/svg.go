@@ -0,0 +1,166 @@
+package badge
+
+/***
+* This file implements rendering of badges in SVG, which look like the ones of shields.io.
+* Styles are:
+*		- flat (default): rounded corners with gradient
+*		- flat-square: square corners without gradient
+*		- for-the-badge: larger, uppercase and bold
+* Text width is estimated from character widths of Verdana, because the renderer can't measure fonts.
+***/
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var Styles = []string{"flat", "flat-square", "for-the-badge"}
+
+func IsValidStyle(style string) bool {
+	_, ok := svgStyles[style]
+	return ok
+}
+
+// Widths of ASCII printable characters (from 0x20) of 11px Verdana.
+var verdanaWidths = [...]float64{
+	3.87, 4.33, 5.05, 9.00, 7.00, 11.84, 7.99, 2.95, 4.99, 4.99, 7.00, 9.00, 4.00, 4.99, 4.00, 4.99,
+	7.00, 7.00, 7.00, 7.00, 7.00, 7.00, 7.00, 7.00, 7.00, 7.00, 4.99, 4.99, 9.00, 9.00, 9.00, 6.00,
+	11.00, 7.52, 7.54, 7.68, 8.48, 6.96, 6.32, 8.53, 8.27, 4.63, 5.00, 7.62, 6.12, 9.27, 8.23, 8.66,
+	6.63, 8.66, 7.65, 7.52, 6.78, 8.05, 7.52, 10.88, 7.54, 6.77, 7.54, 4.99, 4.99, 4.99, 9.00, 7.00,
+	7.00, 6.61, 6.85, 5.73, 6.85, 6.55, 3.87, 6.85, 6.96, 3.02, 3.79, 6.51, 3.02, 10.70, 6.96, 6.68,
+	6.85, 6.85, 4.69, 5.73, 4.33, 6.96, 6.51, 9.00, 6.51, 6.51, 5.78, 6.98, 4.99, 6.98, 9.00,
+}
+
+/***
+* Estimate width of text in 11px Verdana.
+* Characters out of ASCII are regarded as wide ones.
+***/
+func textWidth(text string) float64 {
+	width := 0.0
+	for _, c := range text {
+		switch {
+		case c >= 0x20 && int(c-0x20) < len(verdanaWidths):
+			width += verdanaWidths[c-0x20]
+		case c >= 0x2E80: // CJK and other full-width characters
+			width += 11.0
+		default:
+			width += 7.0
+		}
+	}
+	return width
+}
+
+/***
+* Choose text color readable on the background.
+***/
+func textColors(background string) (string, string) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(background, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(background, "#")) != 6 {
+		return "#fff", "#010101"
+	}
+	r, g, b := float64(value>>16&0xFF), float64(value>>8&0xFF), float64(value&0xFF)
+	brightness := (r*299 + g*587 + b*114) / 255000
+	if brightness > 0.69 {
+		return "#333", "#ccc"
+	}
+	return "#fff", "#010101"
+}
+
+/***
+* Parameters of a style.
+* @height: height of badge
+* @padding: horizontal padding of each side of text
+* @font_size: font size in px
+* @scale: ratio of text width to 11px Verdana
+* @spacing: letter spacing
+***/
+type svgStyle struct {
+	height    int
+	padding   float64
+	font_size int
+	scale     float64
+	spacing   float64
+	upper     bool
+	bold      bool
+	rounded   bool
+	gradient  bool
+	shadow    bool
+}
+
+var svgStyles = map[string]svgStyle{
+	"flat":          {height: 20, padding: 5, font_size: 11, scale: 1, rounded: true, gradient: true, shadow: true},
+	"flat-square":   {height: 20, padding: 5, font_size: 11, scale: 1},
+	"for-the-badge": {height: 28, padding: 9, font_size: 10, scale: 10.0 / 11 * 1.1, spacing: 1.25, upper: true, bold: true},
+}
+
+/***
+* Render a badge of `label` and `message` on `color` background in SVG.
+***/
+func RenderSvg(label string, message string, color string, style string) ([]byte, error) {
+	if len(style) == 0 {
+		style = "flat"
+	}
+	st, ok := svgStyles[style]
+	if !ok {
+		return nil, fmt.Errorf("Unknown badge style: %s", style)
+	}
+	color = "#" + strings.TrimPrefix(color, "#")
+	if st.upper {
+		label = strings.ToUpper(label)
+		message = strings.ToUpper(message)
+	}
+
+	measure := func(text string) float64 {
+		return math.Ceil(textWidth(text)*st.scale + st.spacing*float64(len([]rune(text))))
+	}
+	label_text := measure(label)
+	message_text := measure(message)
+	label_width := label_text + 2*st.padding
+	message_width := message_text + 2*st.padding
+	width := label_width + message_width
+	height := st.height
+
+	var svg strings.Builder
+	title := html.EscapeString(label + ": " + message)
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%g" height="%d" role="img" aria-label="%s">`, width, height, title)
+	fmt.Fprintf(&svg, `<title>%s</title>`, title)
+	if st.gradient {
+		svg.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	}
+	radius := 0
+	if st.rounded {
+		radius = 3
+	}
+	fmt.Fprintf(&svg, `<clipPath id="r"><rect width="%g" height="%d" rx="%d" fill="#fff"/></clipPath>`, width, height, radius)
+	fmt.Fprintf(&svg, `<g clip-path="url(#r)"><rect width="%g" height="%d" fill="#555"/><rect x="%g" width="%g" height="%d" fill="%s"/>`,
+		label_width, height, label_width, message_width, height, html.EscapeString(color))
+	if st.gradient {
+		fmt.Fprintf(&svg, `<rect width="%g" height="%d" fill="url(#s)"/>`, width, height)
+	}
+	svg.WriteString(`</g>`)
+
+	// texts are scaled by 10 for precise positioning, like shields.io
+	weight := ""
+	if st.bold {
+		weight = ` font-weight="bold"`
+	}
+	fmt.Fprintf(&svg, `<g text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" text-rendering="geometricPrecision" font-size="%d"%s>`, st.font_size*10, weight)
+	baseline := float64(height)/2*10 + float64(st.font_size)*10*0.35
+	writeText := func(text string, x float64, length float64, background string) {
+		fill, shadow := textColors(background)
+		escaped := html.EscapeString(text)
+		if st.shadow {
+			fmt.Fprintf(&svg, `<text aria-hidden="true" x="%g" y="%g" fill="%s" fill-opacity=".3" transform="scale(.1)" textLength="%g">%s</text>`,
+				x*10, baseline+10, shadow, length*10, escaped)
+		}
+		fmt.Fprintf(&svg, `<text x="%g" y="%g" fill="%s" transform="scale(.1)" textLength="%g">%s</text>`, x*10, baseline, fill, length*10, escaped)
+	}
+	writeText(label, label_width/2, label_text, "#555")
+	writeText(message, label_width+message_width/2, message_text, color)
+	svg.WriteString(`</g></svg>`)
+
+	return []byte(svg.String()), nil
+}
@@ -0,0 +1,107 @@
+package badge
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/***
+* Check that SVG is well-formed XML and returns its root attributes.
+***/
+func parseSvg(t *testing.T, svg []byte) map[string]string {
+	t.Helper()
+	attrs := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(svg))
+	root := true
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("SVG is not well-formed: %v\n%s", err, svg)
+		}
+		if start, ok := token.(xml.StartElement); ok && root {
+			for _, attr := range start.Attr {
+				attrs[attr.Name.Local] = attr.Value
+			}
+			root = false
+		}
+	}
+	return attrs
+}
+
+func TestTextWidth(t *testing.T) {
+	if w := textWidth("Success"); w < 40 || w > 50 {
+		t.Errorf("Unexpected width of text: %v", w)
+	}
+	if textWidth("iii") >= textWidth("mmm") {
+		t.Error("Narrow characters must be narrower than wide ones.")
+	}
+	if textWidth("あ") <= textWidth("a") {
+		t.Error("Full-width characters must be wide.")
+	}
+}
+
+func TestRenderSvgStyles(t *testing.T) {
+	heights := map[string]string{"": "20", "flat": "20", "flat-square": "20", "for-the-badge": "28"}
+	for style, height := range heights {
+		svg, err := RenderSvg("Success", "1 minute ago", "33FF99", style)
+		if err != nil {
+			t.Fatalf("Failed to render %s badge: %v", style, err)
+		}
+		attrs := parseSvg(t, svg)
+		if attrs["height"] != height || len(attrs["width"]) == 0 {
+			t.Errorf("Unexpected size of %s badge: %v", style, attrs)
+		}
+		if !strings.Contains(string(svg), `fill="#33FF99"`) {
+			t.Errorf("Color must be used as background: %s", svg)
+		}
+	}
+
+	flat, _ := RenderSvg("Success", "now", "33FF99", "flat")
+	square, _ := RenderSvg("Success", "now", "33FF99", "flat-square")
+	if !strings.Contains(string(flat), `rx="3"`) || strings.Contains(string(square), `rx="3"`) || strings.Contains(string(square), "linearGradient") {
+		t.Error("Only flat style must have rounded corners and gradient.")
+	}
+	big, _ := RenderSvg("Success", "now", "33FF99", "for-the-badge")
+	if !strings.Contains(string(big), ">SUCCESS<") || !strings.Contains(string(big), `font-weight="bold"`) {
+		t.Errorf("for-the-badge style must be uppercase and bold: %s", big)
+	}
+
+	if _, err := RenderSvg("Success", "now", "33FF99", "plastic"); err == nil {
+		t.Error("Unknown style must be rejected.")
+	}
+}
+
+func TestRenderSvgText(t *testing.T) {
+	// texts are escaped
+	svg, err := RenderSvg("<script>", "a & b", "CC0000", "flat")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	parseSvg(t, svg)
+	if strings.Contains(string(svg), "<script>") {
+		t.Errorf("Texts must be escaped: %s", svg)
+	}
+
+	// longer message makes wider badge
+	short, _ := RenderSvg("Failure", "now", "CC0000", "flat")
+	long, _ := RenderSvg("Failure", "10 minutes ago", "CC0000", "flat")
+	short_width, _ := strconv.ParseFloat(parseSvg(t, short)["width"], 64)
+	long_width, _ := strconv.ParseFloat(parseSvg(t, long)["width"], 64)
+	if short_width == 0 || short_width >= long_width {
+		t.Error("Badge must be wider for longer message.")
+	}
+
+	// dark text on bright background
+	if fill, _ := textColors("#33FF99"); fill != "#333" {
+		t.Errorf("Text on bright background must be dark: %s", fill)
+	}
+	if fill, _ := textColors("#CC0000"); fill != "#fff" {
+		t.Errorf("Text on dark background must be white: %s", fill)
+	}
+}
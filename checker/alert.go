@@ -0,0 +1,356 @@
+package checker
+
+/***
+* This file implements alerting on state transitions of challenges.
+* `AlertTracker` counts consecutive failures of each challenge, and fires
+*		- failing: when a challenge fails `threshold` times in a row
+*		- recovered: when a challenge alerted as failing succeeds again
+* Infra errors and aborted tests say nothing about challenges, so they neither count nor reset failures.
+* State is kept in memory, so a challenge still failing after restart of checker is alerted again.
+* `Alerter` delivers alerts to notifiers in background, so that slow notifiers don't delay checks.
+***/
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	AlertFailing   = "failing"
+	AlertRecovered = "recovered"
+)
+
+// Default # of consecutive failures to fire alert.
+const defaultAlertThreshold = 1
+
+// Max lines and bytes of stderr of solver attached to alerts.
+const (
+	alertStderrLines = 20
+	alertStderrBytes = 900
+)
+
+/***
+* Config of alerting.
+* @Threshold: # of consecutive failures to fire alert (default 1)
+* @StatusUrl: URL of status page linked from alerts
+* @Webhooks: webhooks alerts are posted to
+* @Email: SMTP server alerts are sent via (no email if null)
+***/
+type AlertConfig struct {
+	Threshold uint            `json:"threshold"`
+	StatusUrl string          `json:"status_url"`
+	Webhooks  []WebhookConfig `json:"webhooks"`
+	Email     *EmailConfig    `json:"email"`
+}
+
+func (conf AlertConfig) threshold() int {
+	if conf.Threshold == 0 {
+		return defaultAlertThreshold
+	}
+	return int(conf.Threshold)
+}
+
+/***
+* Interval to flush alerts queued by batch notifiers in daemon mode.
+***/
+func (conf AlertConfig) digestInterval() time.Duration {
+	if conf.Email == nil || conf.Email.DigestInterval <= 0 {
+		return defaultDigestInterval
+	}
+	return time.Duration(conf.Email.DigestInterval * float64(time.Second))
+}
+
+/***
+* Alert on state transition of a challenge.
+* @Kind: `failing` or `recovered`
+* @Failures: # of consecutive failures (including the last one for failing alert)
+* @Since: when the challenge started failing
+* @PreviousResult, @PreviousStatus: the last result before transition (null if unknown)
+* @Result, @Status, @Error, @RunId, @Timestamp: the result which fires the alert
+* @Attempts, @MaxAttempts, @BuildMs, @RunMs: details of execution of the result
+* @Stderr: tail of stderr of solver
+* @Url: link to status page
+* @Authors: email addresses of authors of the challenge, which are used only to route emails and never posted to webhooks
+***/
+type Alert struct {
+	Kind           string      `json:"kind"`
+	ChallId        int         `json:"challid"`
+	Name           string      `json:"name"`
+	Category       string      `json:"category"`
+	PreviousResult *TestResult `json:"previous_result"`
+	PreviousStatus string      `json:"previous_status"`
+	Result         TestResult  `json:"result"`
+	Status         string      `json:"status"`
+	Error          string      `json:"error"`
+	RunId          string      `json:"runid"`
+	Attempts       uint        `json:"attempt"`
+	MaxAttempts    uint        `json:"max_attempts"`
+	BuildMs        int64       `json:"build_ms"`
+	RunMs          int64       `json:"run_ms"`
+	Stderr         string      `json:"stderr"`
+	Failures       int         `json:"failures"`
+	Since          time.Time   `json:"since"`
+	Timestamp      time.Time   `json:"timestamp"`
+	Hostname       string      `json:"hostname"`
+	Url            string      `json:"url"`
+	Authors        []string    `json:"-"`
+}
+
+func (alert Alert) String() string {
+	if alert.Kind == AlertRecovered {
+		return fmt.Sprintf("[%s] recovered after %d failures since %s.", alert.Name, alert.Failures, alert.Since.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("[%s] failing %d times in a row with %s: %s", alert.Name, alert.Failures, alert.Status, alert.Error)
+}
+
+/***
+* Transition of result shown in alerts (e.g. `Success -> Failure`).
+***/
+func (alert Alert) Transition() string {
+	if alert.PreviousResult == nil {
+		return alert.Status
+	}
+	return fmt.Sprintf("%s -> %s", alert.PreviousStatus, alert.Status)
+}
+
+/***
+* Last `max_lines` lines of text, at most `max_bytes` bytes.
+***/
+func tailLines(text string, max_lines int, max_bytes int) string {
+	text = strings.TrimRight(text, "\n")
+	lines := strings.Split(text, "\n")
+	if len(lines) > max_lines {
+		text = strings.Join(lines[len(lines)-max_lines:], "\n")
+	}
+	if len(text) > max_bytes {
+		cut := len(text) - max_bytes
+		// don't cut in the middle of multi-byte character
+		for cut < len(text) && !utf8.RuneStart(text[cut]) {
+			cut++
+		}
+		text = text[cut:]
+	}
+	return text
+}
+
+/***
+* Destination of alerts.
+***/
+type Notifier interface {
+	// Deliver the alert. It may retry until ctx is done.
+	Notify(ctx context.Context, alert Alert) error
+	// Name shown in logs.
+	String() string
+}
+
+/***
+* Notifier which batches alerts until flushed.
+***/
+type BatchNotifier interface {
+	Notifier
+	// Queue the alert to be delivered on flush.
+	Queue(alert Alert)
+	// Deliver queued alerts.
+	Flush(ctx context.Context) error
+}
+
+/***
+* Failures of a challenge.
+* @alerted: whether failing alert has been fired
+* @last: the last result which tells state of the challenge
+* @before: the last result before failures started
+***/
+type failureState struct {
+	failures int
+	since    time.Time
+	alerted  bool
+	last     *TestResult
+	before   *TestResult
+}
+
+/***
+* Tracker of consecutive failures of challenges.
+***/
+type AlertTracker struct {
+	mu        sync.Mutex
+	threshold int
+	states    map[int]*failureState
+}
+
+func NewAlertTracker(threshold int) *AlertTracker {
+	if threshold <= 0 {
+		threshold = defaultAlertThreshold
+	}
+	return &AlertTracker{threshold: threshold, states: make(map[int]*failureState)}
+}
+
+/***
+* Update state of the challenge by its result at `at`.
+* Returns alert if the result causes transition, or nil.
+***/
+func (tracker *AlertTracker) Observe(chall Challenge, at time.Time) *Alert {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	state, ok := tracker.states[chall.Id]
+	if !ok {
+		state = &failureState{}
+		tracker.states[chall.Id] = state
+	}
+	alert := Alert{
+		ChallId:     chall.Id,
+		Name:        chall.Name,
+		Category:    chall.Category,
+		Result:      chall.Result,
+		Status:      chall.Result.ToMessage(),
+		Error:       shortError(chall.Error),
+		RunId:       chall.RunId,
+		Attempts:    chall.Attempts,
+		MaxAttempts: chall.MaxAttempts,
+		BuildMs:     chall.BuildTime.Milliseconds(),
+		RunMs:       chall.RunTime.Milliseconds(),
+		Stderr:      tailLines(chall.Stderr, alertStderrLines, alertStderrBytes),
+		Timestamp:   at,
+		Hostname:    hostname,
+		Authors:     chall.Authors,
+	}
+	setPrevious := func(previous *TestResult) {
+		if previous != nil {
+			alert.PreviousResult = previous
+			alert.PreviousStatus = previous.ToMessage()
+		}
+	}
+
+	result := chall.Result
+	switch result.state() {
+	case stateUp:
+		recovered := state.alerted
+		alert.Failures, alert.Since = state.failures, state.since
+		setPrevious(state.last)
+		*state = failureState{last: &result}
+		if recovered {
+			alert.Kind = AlertRecovered
+			return &alert
+		}
+	case stateDown:
+		if state.failures == 0 {
+			state.since = at
+			state.before = state.last
+		}
+		state.failures++
+		state.last = &result
+		if !state.alerted && state.failures >= tracker.threshold {
+			state.alerted = true
+			alert.Kind = AlertFailing
+			alert.Failures, alert.Since = state.failures, state.since
+			setPrevious(state.before)
+			return &alert
+		}
+	}
+	return nil
+}
+
+/***
+* Tracker of challenges which delivers alerts to notifiers.
+***/
+type Alerter struct {
+	logger     zap.SugaredLogger
+	tracker    *AlertTracker
+	notifiers  []Notifier
+	status_url string
+	wg         sync.WaitGroup
+}
+
+/***
+* Create alerter of the config. Returns nil if no notifier is configured.
+***/
+func NewAlerter(logger zap.SugaredLogger, conf AlertConfig) (*Alerter, error) {
+	var notifiers []Notifier
+	for _, webhook := range conf.Webhooks {
+		notifier, err := NewWebhookNotifier(webhook)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if conf.Email != nil {
+		email, err := NewEmailNotifier(*conf.Email)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Email.Digest {
+			notifiers = append(notifiers, &EmailDigestNotifier{EmailNotifier: email})
+		} else {
+			notifiers = append(notifiers, email)
+		}
+	}
+	if len(notifiers) == 0 {
+		return nil, nil
+	}
+	alerter := NewAlerterWithNotifiers(logger, conf.threshold(), notifiers)
+	alerter.status_url = conf.StatusUrl
+	return alerter, nil
+}
+
+func NewAlerterWithNotifiers(logger zap.SugaredLogger, threshold int, notifiers []Notifier) *Alerter {
+	return &Alerter{logger: logger, tracker: NewAlertTracker(threshold), notifiers: notifiers}
+}
+
+/***
+* Observe result of a test, and deliver alert in background if it causes transition.
+* Batch notifiers only queue it until `Flush`.
+***/
+func (a *Alerter) Observe(chall Challenge) {
+	alert := a.tracker.Observe(chall, time.Now())
+	if alert == nil {
+		return
+	}
+	alert.Url = a.status_url
+	a.logger.Infof("Alert: %v", alert)
+	for _, notifier := range a.notifiers {
+		if batch, ok := notifier.(BatchNotifier); ok {
+			batch.Queue(*alert)
+			continue
+		}
+		a.wg.Add(1)
+		go func(notifier Notifier) {
+			defer a.wg.Done()
+			if err := notifier.Notify(context.Background(), *alert); err != nil {
+				a.logger.Warnf("Failed to deliver alert of %s to %v: %v", alert.Name, notifier, err)
+			}
+		}(notifier)
+	}
+}
+
+/***
+* Deliver alerts queued by batch notifiers in background.
+***/
+func (a *Alerter) Flush() {
+	for _, notifier := range a.notifiers {
+		batch, ok := notifier.(BatchNotifier)
+		if !ok {
+			continue
+		}
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			if err := batch.Flush(context.Background()); err != nil {
+				a.logger.Warnf("Failed to deliver alerts to %v: %v", batch, err)
+			}
+		}()
+	}
+}
+
+/***
+* Deliver queued alerts, and wait for alerts being delivered.
+***/
+func (a *Alerter) Close() {
+	a.Flush()
+	a.wg.Wait()
+}
@@ -0,0 +1,170 @@
+package checker
+
+/***
+* This file implements payload formats of webhooks.
+* Formats are:
+*		- json (default): `Alert` as it is
+*		- discord: embed of Discord webhook
+*		- slack: attachment with blocks of Slack incoming webhook
+* Colors are the ones of badges of the result.
+***/
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var webhookFormats = map[string]func(Alert) ([]byte, error){
+	"":        formatJson,
+	"json":    formatJson,
+	"discord": formatDiscord,
+	"slack":   formatSlack,
+}
+
+func formatJson(alert Alert) ([]byte, error) {
+	return json.Marshal(alert)
+}
+
+/***
+* Title of alert message.
+***/
+func (alert Alert) title() string {
+	if alert.Kind == AlertRecovered {
+		return fmt.Sprintf("%s recovered", alert.Name)
+	}
+	return fmt.Sprintf("%s is failing", alert.Name)
+}
+
+/***
+* Attempts and durations of execution shown in alert messages.
+***/
+func (alert Alert) attemptsText() string {
+	if alert.MaxAttempts == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d / %d", alert.Attempts, alert.MaxAttempts)
+}
+
+func (alert Alert) durationText() string {
+	return fmt.Sprintf("build %v, run %v",
+		(time.Duration(alert.BuildMs) * time.Millisecond).String(), (time.Duration(alert.RunMs) * time.Millisecond).String())
+}
+
+/***
+* Footer of alert message, which tells where the alert comes from.
+***/
+func (alert Alert) footerText() string {
+	footer := fmt.Sprintf("%d failures since %s", alert.Failures, alert.Since.UTC().Format(time.RFC3339))
+	if len(alert.RunId) != 0 {
+		footer += " | run " + alert.RunId
+	}
+	if len(alert.Hostname) != 0 {
+		footer += " on " + alert.Hostname
+	}
+	return footer
+}
+
+/***
+* Stderr in code block. Backquotes are replaced not to close the block.
+***/
+func codeBlock(text string) string {
+	return "```\n" + strings.ReplaceAll(text, "```", "'''") + "\n```"
+}
+
+/***
+* Payload of Discord webhook.
+* cf. https://discord.com/developers/docs/resources/webhook#execute-webhook
+***/
+func formatDiscord(alert Alert) ([]byte, error) {
+	type field struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+	type embed struct {
+		Title       string  `json:"title"`
+		Url         string  `json:"url,omitempty"`
+		Description string  `json:"description,omitempty"`
+		Color       int64   `json:"color"`
+		Fields      []field `json:"fields"`
+		Footer      struct {
+			Text string `json:"text"`
+		} `json:"footer"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	color, _ := strconv.ParseInt(alert.Result.ToColor(), 16, 64)
+	e := embed{
+		Title:       alert.title(),
+		Url:         alert.Url,
+		Description: alert.Error,
+		Color:       color,
+		Fields: []field{
+			{Name: "Result", Value: alert.Transition(), Inline: true},
+			{Name: "Attempts", Value: alert.attemptsText(), Inline: true},
+			{Name: "Duration", Value: alert.durationText(), Inline: true},
+		},
+		Timestamp: alert.Timestamp,
+	}
+	if len(alert.Stderr) != 0 {
+		e.Fields = append(e.Fields, field{Name: "stderr", Value: codeBlock(alert.Stderr)})
+	}
+	e.Footer.Text = alert.footerText()
+
+	return json.Marshal(struct {
+		Username string  `json:"username"`
+		Embeds   []embed `json:"embeds"`
+	}{"skbctf-status", []embed{e}})
+}
+
+/***
+* Escape text in Slack mrkdwn.
+***/
+func escapeSlack(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+/***
+* Payload of Slack incoming webhook.
+* Blocks are put in an attachment to show the color bar.
+* cf. https://api.slack.com/messaging/webhooks
+***/
+func formatSlack(alert Alert) ([]byte, error) {
+	type object map[string]interface{}
+	mrkdwn := func(text string) object {
+		return object{"type": "mrkdwn", "text": text}
+	}
+
+	title := alert.title()
+	if len(alert.Url) != 0 {
+		title = fmt.Sprintf("<%s|%s>", alert.Url, escapeSlack(title))
+	} else {
+		title = escapeSlack(title)
+	}
+	blocks := []object{
+		{"type": "section", "text": mrkdwn("*" + title + "*")},
+		{"type": "section", "fields": []object{
+			mrkdwn("*Result*\n" + escapeSlack(alert.Transition())),
+			mrkdwn("*Attempts*\n" + alert.attemptsText()),
+			mrkdwn("*Duration*\n" + alert.durationText()),
+		}},
+	}
+	if len(alert.Error) != 0 {
+		blocks = append(blocks, object{"type": "section", "text": mrkdwn(escapeSlack(alert.Error))})
+	}
+	if len(alert.Stderr) != 0 {
+		blocks = append(blocks, object{"type": "section", "text": mrkdwn(codeBlock(escapeSlack(alert.Stderr)))})
+	}
+	blocks = append(blocks, object{"type": "context", "elements": []object{mrkdwn(escapeSlack(alert.footerText()))}})
+
+	return json.Marshal(object{
+		// fallback of notifications
+		"text": fmt.Sprintf("%s: %s", alert.title(), alert.Transition()),
+		"attachments": []object{
+			{"color": "#" + alert.Result.ToColor(), "blocks": blocks},
+		},
+	})
+}
@@ -0,0 +1,123 @@
+package checker
+
+/***
+* This file implements tests of payload formats of webhooks.
+***/
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAlert() Alert {
+	previous := TestSuccess
+	return Alert{
+		Kind: AlertFailing, ChallId: 1, Name: "pwn<1>", Category: "pwn",
+		PreviousResult: &previous, PreviousStatus: previous.ToMessage(), Result: TestFailure, Status: TestFailure.ToMessage(),
+		Error: "exit status 1", RunId: "20211101-000000-abcd", Attempts: 3, MaxAttempts: 3, BuildMs: 1500, RunMs: 2000,
+		Stderr: "Traceback:\n```\nEOFError", Failures: 2, Since: time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+		Timestamp: time.Date(2021, 11, 1, 0, 10, 0, 0, time.UTC), Hostname: "checker-1", Url: "https://status.example.com/",
+		Authors: []string{"author@example.com"},
+	}
+}
+
+func TestFormatJson(t *testing.T) {
+	body, err := formatJson(testAlert())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("Invalid payload: %v\n%s", err, body)
+	}
+	if payload["kind"] != AlertFailing || payload["name"] != "pwn<1>" || payload["previous_status"] != "Success" {
+		t.Errorf("Unexpected payload: %s", body)
+	}
+	// addresses of authors are only for emails
+	if _, ok := payload["authors"]; ok || strings.Contains(string(body), "author@example.com") {
+		t.Errorf("Authors must not be in payload: %s", body)
+	}
+}
+
+func TestFormatDiscord(t *testing.T) {
+	body, err := formatDiscord(testAlert())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var payload struct {
+		Embeds []struct {
+			Title  string
+			Url    string
+			Color  int
+			Fields []struct {
+				Name  string
+				Value string
+			}
+			Footer struct{ Text string }
+		}
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || len(payload.Embeds) != 1 {
+		t.Fatalf("Invalid payload: %v\n%s", err, body)
+	}
+	embed := payload.Embeds[0]
+	if embed.Title != "pwn<1> is failing" || embed.Url != "https://status.example.com/" || embed.Color != 0xCC0000 {
+		t.Errorf("Unexpected embed: %+v", embed)
+	}
+	if len(embed.Fields) != 4 || embed.Fields[0].Value != "Success -> Failure" || embed.Fields[1].Value != "3 / 3" || embed.Fields[2].Value != "build 1.5s, run 2s" {
+		t.Errorf("Unexpected fields: %+v", embed.Fields)
+	}
+	if stderr := embed.Fields[3].Value; strings.Count(stderr, "```") != 2 || !strings.HasSuffix(stderr, "EOFError\n```") {
+		t.Errorf("Stderr must be in a code block: %q", stderr)
+	}
+	if !strings.Contains(embed.Footer.Text, "run 20211101-000000-abcd on checker-1") {
+		t.Errorf("Unexpected footer: %s", embed.Footer.Text)
+	}
+}
+
+func TestFormatSlack(t *testing.T) {
+	alert := testAlert()
+	alert.Kind = AlertRecovered
+	previous := TestTimeout
+	alert.PreviousResult, alert.PreviousStatus = &previous, previous.ToMessage()
+	alert.Result, alert.Status = TestSuccess, TestSuccess.ToMessage()
+	body, err := formatSlack(alert)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var payload struct {
+		Text        string
+		Attachments []struct {
+			Color  string
+			Blocks []struct {
+				Type string
+				Text struct{ Text string }
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || len(payload.Attachments) != 1 {
+		t.Fatalf("Invalid payload: %v\n%s", err, body)
+	}
+	attachment := payload.Attachments[0]
+	if payload.Text != "pwn<1> recovered: Timeout -> Success" || attachment.Color != "#33FF99" || len(attachment.Blocks) != 5 {
+		t.Errorf("Unexpected payload: %s", body)
+	}
+	if title := attachment.Blocks[0].Text.Text; title != "*<https://status.example.com/|pwn&lt;1&gt; recovered>*" {
+		t.Errorf("Title must be escaped link: %s", title)
+	}
+	if attachment.Blocks[4].Type != "context" {
+		t.Errorf("Footer must be context block: %s", body)
+	}
+}
+
+func TestWebhookFormat(t *testing.T) {
+	if _, err := NewWebhookNotifier(WebhookConfig{Url: "https://example.com/", Format: "teams"}); err == nil {
+		t.Error("Unknown format must be rejected.")
+	}
+	for _, format := range []string{"", "json", "discord", "slack"} {
+		if _, err := NewWebhookNotifier(WebhookConfig{Url: "https://example.com/", Format: format}); err != nil {
+			t.Errorf("Format %s must be accepted: %v", format, err)
+		}
+	}
+}
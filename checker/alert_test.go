@@ -0,0 +1,114 @@
+package checker
+
+/***
+* This file implements tests of alerting.
+***/
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAlertTracker(t *testing.T) {
+	tracker := NewAlertTracker(3)
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	observe := func(minutes int, result TestResult) *Alert {
+		return tracker.Observe(Challenge{Name: "pwn-1", Id: 1, Category: "pwn", Result: result, Error: "exit status 1\nmore"}, start.Add(time.Duration(minutes)*time.Minute))
+	}
+
+	// failures less than threshold, reset by success
+	if observe(0, TestFailure) != nil || observe(1, TestTimeout) != nil || observe(2, TestSuccess) != nil {
+		t.Error("Alert must not be fired before threshold.")
+	}
+
+	// infra errors neither count nor reset failures
+	observe(3, TestFailure)
+	observe(4, TestInfraError)
+	observe(5, TestWrongFlag)
+	alert := observe(6, TestFailure)
+	if alert == nil || alert.Kind != AlertFailing || alert.Failures != 3 || !alert.Since.Equal(start.Add(3*time.Minute)) {
+		t.Fatalf("Unexpected failing alert: %+v", alert)
+	}
+	if alert.Name != "pwn-1" || alert.Category != "pwn" || alert.Status != "Failure" || alert.Error != "exit status 1" {
+		t.Errorf("Unexpected content of alert: %+v", alert)
+	}
+	if alert.PreviousResult == nil || *alert.PreviousResult != TestSuccess || alert.Transition() != "Success -> Failure" {
+		t.Errorf("Previous result must be the one before failures: %+v", alert)
+	}
+
+	// fired only once while failing
+	if observe(7, TestFailure) != nil || observe(8, TestAborted) != nil {
+		t.Error("Alert must not be fired again while failing.")
+	}
+	alert = observe(9, TestSuccessWithoutExecution)
+	if alert == nil || alert.Kind != AlertRecovered || alert.Failures != 4 || !alert.Since.Equal(start.Add(3*time.Minute)) {
+		t.Fatalf("Unexpected recovered alert: %+v", alert)
+	}
+	if alert.PreviousResult == nil || *alert.PreviousResult != TestFailure || alert.Transition() != "Failure -> Success" {
+		t.Errorf("Previous result must be the last failure: %+v", alert)
+	}
+	if observe(10, TestSuccess) != nil {
+		t.Error("Recovery must be alerted only once.")
+	}
+
+	// other challenges are tracked separately, and failing from the start has no previous result
+	tracker = NewAlertTracker(1)
+	if alert := tracker.Observe(Challenge{Id: 2, Result: TestTimeout}, start); alert == nil || alert.PreviousResult != nil || alert.Transition() != "Timeout" {
+		t.Errorf("Unexpected alert of new challenge: %+v", alert)
+	}
+	if tracker.Observe(Challenge{Id: 3, Result: TestSuccess}, start) != nil || len(tracker.states) != 2 {
+		t.Error("Challenges must be tracked separately.")
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	if tail := tailLines("a\nb\nc\nd\n\n", 2, 100); tail != "c\nd" {
+		t.Errorf("Unexpected tail of lines: %q", tail)
+	}
+	if tail := tailLines("あいう", 10, 4); tail != "う" {
+		t.Errorf("Tail must not break multi-byte characters: %q", tail)
+	}
+}
+
+func TestAlerterWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var received []Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, alert)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	alerter, err := NewAlerter(*zap.NewNop().Sugar(), AlertConfig{Threshold: 2, Webhooks: []WebhookConfig{{Url: server.URL}}})
+	if err != nil || alerter == nil {
+		t.Fatalf("Failed to create alerter: %v", err)
+	}
+	for _, result := range []TestResult{TestFailure, TestFailure, TestFailure, TestSuccess} {
+		alerter.Observe(Challenge{Name: "web-1", Id: 5, Result: result})
+		// keep order of deliveries
+		alerter.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].Kind != AlertFailing || received[1].Kind != AlertRecovered || received[1].ChallId != 5 || received[1].Failures != 3 {
+		t.Errorf("Unexpected alerts: %+v", received)
+	}
+
+	// alerting is disabled without notifiers
+	if alerter, err := NewAlerter(*zap.NewNop().Sugar(), AlertConfig{}); alerter != nil || err != nil {
+		t.Errorf("Alerter without notifiers must be nil: %v", err)
+	}
+}
@@ -5,16 +5,17 @@ package checker
 * Checker manages test flow, including:
 * 	- enumerationg challenges
 * 	- init Executer and do execute tests
-*		- record test results into DB
+*		- record test results into result store
 * Checker itself does tests only for once for each challs.
 **/
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
-	"os"
 	"path/filepath"
+	"time"
 
-	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 )
 
@@ -40,94 +41,222 @@ func enumerateChallsDir(challs_dirname string) ([]string, error) {
 	return challs, nil
 }
 
+/***
+* Checker of all challenges.
+* @runner: backend to build and run solvers, shared by all executers
+* @store: storage of test results, which is opened at the first check
+* @alerter: alerter on state transitions of challenges (nil if alerting is not configured)
+***/
+type Checker struct {
+	logger  zap.SugaredLogger
+	conf    CheckerConfig
+	runner  Runner
+	store   ResultStore
+	alerter *Alerter
+}
+
+func NewChecker(logger zap.SugaredLogger, conf CheckerConfig) (*Checker, error) {
+	runner, err := NewRunner(conf)
+	if err != nil {
+		return nil, err
+	}
+	alerter, err := NewAlerter(logger, conf.Alert)
+	if err != nil {
+		return nil, err
+	}
+	return &Checker{logger: logger, conf: conf, runner: runner, alerter: alerter}, nil
+}
+
+/***
+* Number of tests executed at the same time.
+* Sequential execution is a pool of single worker.
+***/
+func (c *Checker) numWorkers() uint {
+	if c.conf.Parallel && c.conf.ParallelNum > 1 {
+		return c.conf.ParallelNum
+	}
+	return 1
+}
+
+func (c *Checker) newExecuter(challdir string, run_id string) *Executer {
+	return &Executer{
+		path:          challdir,
+		logger:        c.logger,
+		retry_max:     c.conf.Retries,
+		runner:        c.runner,
+		run_id:        run_id,
+		log_dir:       c.conf.LogDir,
+		conf:          c.conf,
+		infra_backoff: infraRetryBackoff,
+	}
+}
+
 /***
 * Do entire test process flow only once for all challenges.
 * Process flow means enumerating challs, executing tests, and write results on DB.
+* If ctx is cancelled, tests not started yet are skipped.
 ***/
-func CheckAllOnce(logger zap.SugaredLogger, conf CheckerConfig) error {
-	// prepare DB
-	var db *sqlx.DB
-	var err error
-	if !conf.Nodb {
-		db, err = Connect(os.Getenv("DBUSER"), os.Getenv("DBPASS"), os.Getenv("DBHOST"), os.Getenv("DBNAME"))
-		if err != nil {
-			return err
-		}
+func (c *Checker) CheckAllOnce(ctx context.Context) (Summary, error) {
+	summary := newSummary(NewRunId())
+
+	// prepare result store
+	if err := c.ensureStore(); err != nil {
+		return summary, err
 	}
 
 	// enumerate challenge dirs
-	challs, err := enumerateChallsDir(conf.ChallsDir)
+	challs, err := enumerateChallsDir(c.conf.ChallsDir)
 	if err != nil {
-		return err
+		return summary, err
 	}
-
-	logger.Infof("found %d tests.", len(challs))
+	c.logger.Infof("found %d tests. (run ID: %s)", len(challs), summary.RunId)
 
 	// execute tests
-	if conf.Parallel {
-		// Parallel test execution
-		executers_wait_que := make([]Executer, 0)
-		num_running := 0
-		ch := make(chan Challenge, len(challs))
-
-		// init executer and push them into waiting que
-		for _, challdir := range challs {
-			executer := Executer{path: challdir, logger: logger, retry_max: conf.Retries, try_current: 0}
-			executers_wait_que = append(executers_wait_que, executer)
-		}
+	executers := make([]*Executer, 0, len(challs))
+	for _, challdir := range challs {
+		executers = append(executers, c.newExecuter(challdir, summary.RunId))
+	}
+	start_time := time.Now()
+	runPool(ctx, executers, c.numWorkers(), c.conf.Infofile, c.conf.Timeout, func(chall Challenge, elapsed time.Duration) {
+		c.logger.Infof("[%s] Test execution finish with %v.", chall.Name, chall.Result)
+		summary.add(chall, elapsed)
+		c.record(chall)
+	})
+	summary.Elapsed = time.Since(start_time)
+	if c.alerter != nil {
+		c.alerter.Flush()
+	}
 
-		// exec all
-		for conf.ParallelNum > uint(num_running) && len(executers_wait_que) > 0 {
-			executer := executers_wait_que[0]
-			executers_wait_que = executers_wait_que[1:]
-			go executer.CheckWithTimeout(ch, conf.Infofile, conf.Timeout)
-			num_running++
-		}
+	c.logger.Infof("%v", summary)
+	return summary, nil
+}
 
-		// wait and get results
-		for result := range ch {
-			logger.Infof("[%s] Test execution finish with %v.", result.Name, result.Result)
-			num_running--
-
-			// pop from waiting queue and execute test
-			for conf.ParallelNum > uint(num_running) && len(executers_wait_que) > 0 {
-				executer := executers_wait_que[0]
-				executers_wait_que = executers_wait_que[1:]
-				go executer.CheckWithTimeout(ch, conf.Infofile, conf.Timeout)
-				num_running++
-			}
-
-			// write result to DB
-			if !conf.Nodb {
-				if err := RecordResult(db, result); err != nil {
-					logger.Warn("%v", err)
-				}
-			}
-
-			// end of tests
-			if num_running == 0 && len(executers_wait_que) == 0 {
-				close(ch)
-			}
+/***
+* Open result store of the config.
+* Without DB, results are kept in memory and snapshotted into `snapshot` file if specified.
+* Schema of DB is migrated to the latest version.
+***/
+func (c *Checker) openStore() (ResultStore, error) {
+	if c.conf.Nodb {
+		if len(c.conf.Snapshot) == 0 {
+			return NewMemoryStore(), nil
 		}
-	} else {
-		// Sequential test execution
-		for _, challdir := range challs {
-			ch := make(chan Challenge, 1)
-			executer := Executer{path: challdir, logger: logger, retry_max: conf.Retries, try_current: 0}
-
-			// blocking execution of test
-			go executer.CheckWithTimeout(ch, conf.Infofile, conf.Timeout)
-			chall := <-ch
-
-			// write a result to DB
-			if !conf.Nodb {
-				if err := RecordResult(db, chall); err != nil {
-					logger.Warn("%v", err)
-				}
-			}
-			logger.Infof("[%s] Test execution finish: %v", chall.Name, chall.Result)
+		return NewFileStore(c.conf.Snapshot, snapshotInterval)
+	}
+	store, err := OpenStore(c.conf.DbDriver, c.conf.DbDsn)
+	if err != nil {
+		return nil, err
+	}
+	if versioned, ok := store.(VersionedStore); ok {
+		if from, to := versioned.SchemaVersions(); from != to {
+			c.logger.Infof("Schema of result store is migrated from version %d to %d.", from, to)
 		}
 	}
+	return store, nil
+}
+
+/***
+* Open result store if it's not opened yet.
+***/
+func (c *Checker) ensureStore() error {
+	if c.store != nil {
+		return nil
+	}
+	store, err := c.openStore()
+	if err != nil {
+		return err
+	}
+	c.store = store
+	return nil
+}
+
+/***
+* Write result of a test to result store, and alert if state of the challenge changes.
+***/
+func (c *Checker) record(chall Challenge) {
+	if c.alerter != nil {
+		c.alerter.Observe(chall)
+	}
+	if err := c.ensureStore(); err != nil {
+		c.logger.Warnf("%v", err)
+		return
+	}
+	if err := c.store.RecordResult(chall); err != nil {
+		c.logger.Warnf("%v", err)
+	}
+}
 
+/***
+* Open result store to apply schema migrations, without checking challenges.
+***/
+func (c *Checker) Migrate() error {
+	if c.conf.Nodb {
+		return fmt.Errorf("Result store is not used in nodb mode.")
+	}
+	if c.store != nil {
+		c.store.Close()
+	}
+	store, err := c.openStore()
+	if err != nil {
+		return err
+	}
+	c.store = store
+	if versioned, ok := store.(VersionedStore); ok {
+		_, to := versioned.SchemaVersions()
+		c.logger.Infof("Schema of result store is version %d.", to)
+	}
 	return nil
 }
+
+/***
+* Roll raw results older than retention period into aggregates.
+* Returns # of rolled results. Nothing is done if retention is not configured.
+***/
+func (c *Checker) Prune() (int, error) {
+	policy := c.conf.RetentionPolicy
+	if policy.Days <= 0 {
+		return 0, nil
+	}
+	if err := policy.validate(); err != nil {
+		return 0, err
+	}
+	if err := c.ensureStore(); err != nil {
+		return 0, err
+	}
+
+	cutoff := policy.cutoff(time.Now())
+	pruned, err := c.store.Prune(cutoff, policy.granularity())
+	if err != nil {
+		return 0, err
+	}
+	if pruned != 0 {
+		c.logger.Infof("%d results before %v are rolled into %s aggregates.", pruned, cutoff.Format(time.RFC3339), policy.granularity())
+	}
+	return pruned, nil
+}
+
+/***
+* Release resources of the checker.
+***/
+func (c *Checker) Close() error {
+	if c.alerter != nil {
+		c.alerter.Close()
+	}
+	if c.store != nil {
+		return c.store.Close()
+	}
+	return nil
+}
+
+/***
+* Do entire test process flow only once for all challenges with new checker.
+***/
+func CheckAllOnce(ctx context.Context, logger zap.SugaredLogger, conf CheckerConfig) (Summary, error) {
+	checker, err := NewChecker(logger, conf)
+	if err != nil {
+		return Summary{}, err
+	}
+	defer checker.Close()
+
+	return checker.CheckAllOnce(ctx)
+}
@@ -21,7 +21,25 @@ type CheckerConfig struct {
 	Nodb        bool    `json:"nodb"`
 	ChallsDir   string  `json:"challs"`
 	Interval    uint    `json:"interval"`
+	Jitter      float64 `json:"jitter"`
 	Retries     uint    `json:"retries"`
+	Runner      string  `json:"runner"`
+	DockerSock  string  `json:"dockersock"`
+	LogDir      string  `json:"logdir"`
+	// storage of test results (see `OpenStore`)
+	DbDriver string `json:"dbdriver"`
+	DbDsn    string `json:"dbdsn"`
+	Snapshot string `json:"snapshot"`
+	// defaults of connection information of challenges
+	Host string            `json:"host"`
+	Port int               `json:"port"`
+	Env  map[string]string `json:"env"`
+	// defaults of resource limits of solvers
+	ResourceLimits
+	// retention of test results
+	RetentionPolicy
+	// alerting on failures and recoveries of challenges
+	Alert AlertConfig `json:"alert"`
 }
 
 func (ch *CheckerConfig) ResolveConflict() {
@@ -40,6 +58,9 @@ func (ch *CheckerConfig) Validate() {
 	if ch.Timeout < 0 {
 		ch.Timeout = 0
 	}
+	if ch.Days < 0 {
+		ch.Days = 0
+	}
 }
 
 func ReadConf(filename string) (CheckerConfig, error) {
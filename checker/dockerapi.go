@@ -0,0 +1,390 @@
+package checker
+
+/***
+* This file implements Runner which talks to Docker Engine API over unix socket.
+* Unlike DockerCliRunner, it doesn't depend on `docker` command and shell,
+* and it can get build logs and exit code of solvers reliably.
+***/
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+/***
+* Runner which uses Docker Engine API.
+* @socket: path to unix socket of Docker daemon
+***/
+type DockerApiRunner struct {
+	socket string
+	client *http.Client
+}
+
+func NewDockerApiRunner(socket string) *DockerApiRunner {
+	if len(socket) == 0 {
+		socket = DefaultDockerSocket
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &DockerApiRunner{socket: socket, client: &http.Client{Transport: transport}}
+}
+
+/***
+* Error returned by Docker Engine API.
+***/
+type dockerApiError struct {
+	StatusCode int
+	Message    string `json:"message"`
+}
+
+func (e *dockerApiError) Error() string {
+	return fmt.Sprintf("docker API returned %d: %s", e.StatusCode, e.Message)
+}
+
+/***
+* Send request to Docker daemon.
+* Response body must be closed by caller if error is nil.
+* Status codes other than 2XX are converted into `dockerApiError`.
+***/
+func (r *DockerApiRunner) request(ctx context.Context, method string, path string, query url.Values, content_type string, body io.Reader) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if len(content_type) != 0 {
+		req.Header.Set("Content-Type", content_type)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// failed to talk to Docker daemon
+		return nil, &InfraError{Err: err}
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		apierr := dockerApiError{StatusCode: res.StatusCode}
+		msg, _ := ioutil.ReadAll(res.Body)
+		if err := json.Unmarshal(msg, &apierr); err != nil {
+			apierr.Message = strings.TrimSpace(string(msg))
+		}
+		return nil, &apierr
+	}
+	return res, nil
+}
+
+/***
+* Send JSON request and decode JSON response into `out` if it's not nil.
+***/
+func (r *DockerApiRunner) requestJson(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	var body io.Reader
+	content_type := ""
+	if in != nil {
+		in_bytes, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(in_bytes)
+		content_type = "application/json"
+	}
+
+	res, err := r.request(ctx, method, path, query, content_type, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+/***
+* Whether `err` (or an error it wraps) is `dockerApiError` of any of the status codes.
+***/
+func hasApiStatus(err error, codes ...int) bool {
+	var apierr *dockerApiError
+	if !errors.As(err, &apierr) {
+		return false
+	}
+	for _, code := range codes {
+		if apierr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	return hasApiStatus(err, http.StatusNotFound)
+}
+
+/***
+* Whether the container is already removed or not running.
+***/
+func isNotRunning(err error) bool {
+	return hasApiStatus(err, http.StatusNotFound, http.StatusConflict)
+}
+
+/***
+* Create tar archive of build context directory.
+***/
+func tarContext(dir string) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(&buf)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+/***
+* A message of JSON stream returned by `/build`.
+***/
+type buildMessage struct {
+	Stream string `json:"stream"`
+	Error  string `json:"error"`
+	Aux    struct {
+		ID string `json:"ID"`
+	} `json:"aux"`
+}
+
+func (r *DockerApiRunner) Build(ctx context.Context, chall Challenge) (string, error) {
+	image_name := fmt.Sprintf("solver_%d", chall.Id)
+	context_tar, err := tarContext(chall.Exploit_dir_name)
+	if err != nil {
+		return "", fmt.Errorf("[%s] Failed to create build context: %v", chall.Name, err)
+	}
+
+	query := url.Values{}
+	query.Set("t", image_name)
+	query.Set("rm", "1")
+	query.Set("forcerm", "1")
+	res, err := r.request(ctx, "POST", "/build", query, "application/x-tar", context_tar)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	// read build logs until the end of stream
+	var logs strings.Builder
+	image := ""
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var msg buildMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("[%s] Failed to read build output: %v", chall.Name, err)
+		}
+		logs.WriteString(msg.Stream)
+		if len(msg.Error) != 0 {
+			return "", fmt.Errorf("[%s] docker build failed: %s\n%s", chall.Name, msg.Error, logs.String())
+		}
+		if len(msg.Aux.ID) != 0 {
+			image = msg.Aux.ID
+		}
+	}
+
+	if len(image) == 0 {
+		image = image_name
+	}
+	return image, nil
+}
+
+func (r *DockerApiRunner) Run(ctx context.Context, chall Challenge, image string, container string, stdout io.Writer, stderr io.Writer) (int, error) {
+	// create container
+	var created struct {
+		Id string `json:"Id"`
+	}
+	query := url.Values{}
+	query.Set("name", container)
+	config := map[string]interface{}{
+		"Image": image,
+		"Env":   chall.Environ(),
+	}
+	if args := chall.CommandArgs(); len(args) != 0 {
+		config["Cmd"] = args
+	}
+	if host_config := hostConfig(chall.ResourceLimits); len(host_config) != 0 {
+		config["HostConfig"] = host_config
+	}
+	if err := r.requestJson(ctx, "POST", "/containers/create", query, config, &created); err != nil {
+		return -1, err
+	}
+
+	// start container
+	if err := r.requestJson(ctx, "POST", fmt.Sprintf("/containers/%s/start", created.Id), nil, nil, nil); err != nil {
+		return -1, err
+	}
+
+	// wait container exits
+	var waited struct {
+		StatusCode int `json:"StatusCode"`
+		Error      *struct {
+			Message string `json:"Message"`
+		} `json:"Error"`
+	}
+	if err := r.requestJson(ctx, "POST", fmt.Sprintf("/containers/%s/wait", created.Id), nil, nil, &waited); err != nil {
+		return -1, err
+	}
+
+	// collect outputs of exited container
+	if err := r.readLogs(ctx, created.Id, stdout, stderr); err != nil {
+		return waited.StatusCode, fmt.Errorf("[%s] Failed to read outputs of container: %v", chall.Name, err)
+	}
+	if waited.Error != nil && len(waited.Error.Message) != 0 {
+		return waited.StatusCode, fmt.Errorf("[%s] Failed to wait container: %s", chall.Name, waited.Error.Message)
+	}
+
+	return waited.StatusCode, nil
+}
+
+/***
+* Convert resource limits into `HostConfig` of container.
+***/
+func hostConfig(limits ResourceLimits) map[string]interface{} {
+	host_config := make(map[string]interface{})
+	if limits.Memory > 0 {
+		host_config["Memory"] = limits.Memory * 1024 * 1024
+		host_config["MemorySwap"] = limits.Memory * 1024 * 1024
+	}
+	if limits.Cpus > 0 {
+		host_config["NanoCpus"] = int64(limits.Cpus * 1e9)
+	}
+	if limits.Pids > 0 {
+		host_config["PidsLimit"] = limits.Pids
+	}
+	if limits.isReadOnly() {
+		host_config["ReadonlyRootfs"] = true
+		host_config["Tmpfs"] = map[string]string{"/tmp": ""}
+	}
+	if len(limits.Network) != 0 {
+		host_config["NetworkMode"] = limits.Network
+	}
+	return host_config
+}
+
+/***
+* Read stdout and stderr of the container.
+* Logs of containers without TTY are multiplexed with 8-byte headers:
+*		[stream type(1), 0, 0, 0, size(4, big endian)]
+***/
+func (r *DockerApiRunner) readLogs(ctx context.Context, container string, stdout io.Writer, stderr io.Writer) error {
+	query := url.Values{}
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	res, err := r.request(ctx, "GET", fmt.Sprintf("/containers/%s/logs", container), query, "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(res.Body, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var dst io.Writer
+		switch header[0] {
+		case 1:
+			dst = stdout
+		case 2:
+			dst = stderr
+		default:
+			dst = ioutil.Discard
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(dst, res.Body, size); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *DockerApiRunner) Kill(container string) error {
+	// ctx of Run is already cancelled on shutdown, so container must be killed regardless of it
+	err := r.requestJson(context.Background(), "POST", fmt.Sprintf("/containers/%s/kill", container), nil, nil, nil)
+	if err != nil && !isNotRunning(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *DockerApiRunner) Cleanup(container string) error {
+	query := url.Values{}
+	query.Set("force", "1")
+	err := r.requestJson(context.Background(), "DELETE", fmt.Sprintf("/containers/%s", container), query, nil, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("Failed to remove container(%s): %v", container, err)
+	}
+	return nil
+}
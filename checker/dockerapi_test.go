@@ -0,0 +1,286 @@
+package checker
+
+/***
+* This file implements tests of Docker Engine API runner against fake Docker daemon.
+***/
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/***
+* Fake Docker daemon which serves minimum Engine API on unix socket.
+* @exit_code: exit code of every container
+* @build_error: if not empty, build fails with this message
+***/
+type fakeDockerDaemon struct {
+	mu          sync.Mutex
+	exit_code   int
+	build_error string
+	built_files []string
+	containers  map[string]chan bool
+	removed     []string
+	created     []map[string]interface{}
+}
+
+func startFakeDockerDaemon(t *testing.T, daemon *fakeDockerDaemon) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket: %v", err)
+	}
+	daemon.containers = make(map[string]chan bool)
+
+	server := httptest.NewUnstartedServer(daemon)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return socket
+}
+
+func (d *fakeDockerDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/build":
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			d.built_files = append(d.built_files, header.Name)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.Encode(map[string]string{"stream": "Step 1/1 : FROM scratch\n"})
+		if len(d.build_error) != 0 {
+			encoder.Encode(map[string]string{"error": d.build_error})
+			return
+		}
+		encoder.Encode(map[string]interface{}{"aux": map[string]string{"ID": "sha256:deadbeef"}})
+
+	case r.Method == "POST" && r.URL.Path == "/containers/create":
+		name := r.URL.Query().Get("name")
+		var config map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&config)
+		d.created = append(d.created, config)
+		d.containers[name] = make(chan bool)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": name})
+
+	case r.Method == "POST" && len(parts) == 3 && parts[2] == "start":
+		if _, ok := d.containers[parts[1]]; !ok {
+			http.Error(w, `{"message": "no such container"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "POST" && len(parts) == 3 && parts[2] == "wait":
+		killed := d.containers[parts[1]]
+		exit_code := d.exit_code
+		d.mu.Unlock()
+		if exit_code < 0 {
+			<-killed
+			exit_code = 137
+		}
+		d.mu.Lock()
+		json.NewEncoder(w).Encode(map[string]int{"StatusCode": exit_code})
+
+	case r.Method == "GET" && len(parts) == 3 && parts[2] == "logs":
+		for stream, msg := range []string{"", "fake stdout\n", "fake stderr\n"} {
+			if len(msg) == 0 {
+				continue
+			}
+			header := make([]byte, 8)
+			header[0] = byte(stream)
+			binary.BigEndian.PutUint32(header[4:], uint32(len(msg)))
+			w.Write(append(header, msg...))
+		}
+
+	case r.Method == "POST" && len(parts) == 3 && parts[2] == "kill":
+		killed, ok := d.containers[parts[1]]
+		if !ok {
+			http.Error(w, `{"message": "no such container"}`, http.StatusNotFound)
+			return
+		}
+		select {
+		case <-killed:
+		default:
+			close(killed)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "containers":
+		if _, ok := d.containers[parts[1]]; !ok {
+			http.Error(w, `{"message": "no such container"}`, http.StatusNotFound)
+			return
+		}
+		delete(d.containers, parts[1])
+		d.removed = append(d.removed, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, fmt.Sprintf(`{"message": "unknown endpoint %s"}`, r.URL.Path), http.StatusNotFound)
+	}
+}
+
+func TestDockerApiRunner(t *testing.T) {
+	daemon := &fakeDockerDaemon{exit_code: 3}
+	socket := startFakeDockerDaemon(t, daemon)
+	runner := NewDockerApiRunner(socket)
+	challdir := createFakeChall(t, t.TempDir(), `{"name": "api", "id": 20}`)
+	chall := Challenge{Name: "api", Id: 20, Exploit_dir_name: filepath.Join(challdir, "exploit"), Host: "localhost", Args: []string{"$CHALL_HOST"}}
+
+	// build sends context as tar
+	image, err := runner.Build(context.Background(), chall)
+	if err != nil {
+		t.Fatalf("Failed to build: %v", err)
+	}
+	if image != "sha256:deadbeef" {
+		t.Errorf("Unexpected image ID: %s", image)
+	}
+	if len(daemon.built_files) != 1 || daemon.built_files[0] != "Dockerfile" {
+		t.Errorf("Unexpected build context: %v", daemon.built_files)
+	}
+
+	// exit code and outputs of container are returned
+	var stdout, stderr bytes.Buffer
+	exit_code, err := runner.Run(context.Background(), chall, image, "solver_api", &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+	if exit_code != 3 {
+		t.Errorf("Unexpected exit code: %d", exit_code)
+	}
+	if stdout.String() != "fake stdout\n" || stderr.String() != "fake stderr\n" {
+		t.Errorf("Unexpected outputs: %q, %q", stdout.String(), stderr.String())
+	}
+	if config := fmt.Sprint(daemon.created[0]); config != "map[Cmd:[localhost] Env:[CHALL_HOST=localhost] Image:sha256:deadbeef]" {
+		t.Errorf("Unexpected container config: %s", config)
+	}
+
+	// cleanup removes container, and it's fine to cleanup twice
+	if err := runner.Cleanup("solver_api"); err != nil {
+		t.Errorf("Failed to cleanup: %v", err)
+	}
+	if err := runner.Cleanup("solver_api"); err != nil {
+		t.Errorf("Cleanup of removed container must succeed: %v", err)
+	}
+	if len(daemon.removed) != 1 {
+		t.Errorf("Container is not removed: %v", daemon.removed)
+	}
+
+	// build error is reported with logs
+	daemon.build_error = "fake build error"
+	if _, err := runner.Build(context.Background(), chall); err == nil || !strings.Contains(err.Error(), "fake build error") {
+		t.Errorf("Build error must be reported: %v", err)
+	}
+}
+
+func TestDockerApiRunnerKill(t *testing.T) {
+	daemon := &fakeDockerDaemon{exit_code: -1}
+	socket := startFakeDockerDaemon(t, daemon)
+	runner := NewDockerApiRunner(socket)
+	chall := Challenge{Name: "api kill", Id: 21}
+
+	done := make(chan int)
+	go func() {
+		exit_code, _ := runner.Run(context.Background(), chall, "sha256:deadbeef", "solver_kill", ioutil.Discard, ioutil.Discard)
+		done <- exit_code
+	}()
+
+	// wait until container is created
+	for {
+		daemon.mu.Lock()
+		_, ok := daemon.containers["solver_kill"]
+		daemon.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := runner.Kill("solver_kill"); err != nil {
+		t.Errorf("Failed to kill: %v", err)
+	}
+	if exit_code := <-done; exit_code != 137 {
+		t.Errorf("Killed container must exit with 137: %d", exit_code)
+	}
+}
+
+func TestDockerApiRunnerCancel(t *testing.T) {
+	daemon := &fakeDockerDaemon{exit_code: -1}
+	socket := startFakeDockerDaemon(t, daemon)
+	runner := NewDockerApiRunner(socket)
+	chall := Challenge{Name: "api cancel", Id: 22}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := runner.Run(ctx, chall, "sha256:deadbeef", "solver_cancel", ioutil.Discard, ioutil.Discard)
+		done <- err
+	}()
+	for {
+		daemon.mu.Lock()
+		_, ok := daemon.containers["solver_cancel"]
+		daemon.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// waiting container is aborted without killing it
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil || IsInfraError(err) {
+			t.Errorf("Cancelled run must fail without infra error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run must return when ctx is cancelled.")
+	}
+
+	// container is killed after ctx is cancelled
+	if err := runner.Kill("solver_cancel"); err != nil {
+		t.Errorf("Failed to kill: %v", err)
+	}
+}
+
+func TestDockerApiRunnerUnreachable(t *testing.T) {
+	runner := NewDockerApiRunner(filepath.Join(t.TempDir(), "nonexistent.sock"))
+	if _, err := runner.Run(context.Background(), Challenge{}, "image", "container", ioutil.Discard, ioutil.Discard); !IsInfraError(err) {
+		t.Errorf("Run must fail with infra error when daemon is unreachable: %v", err)
+	}
+}
+
+func TestDockerApiErrorStatus(t *testing.T) {
+	conflict := fmt.Errorf("Failed to kill: %w", &dockerApiError{StatusCode: http.StatusConflict})
+	not_found := fmt.Errorf("Failed to remove: %w", &dockerApiError{StatusCode: http.StatusNotFound})
+	if isNotFound(conflict) || !isNotFound(not_found) {
+		t.Error("Wrapped 404 must be regarded as not found.")
+	}
+	if !isNotRunning(conflict) || !isNotRunning(not_found) || isNotRunning(&dockerApiError{StatusCode: http.StatusInternalServerError}) {
+		t.Error("Wrapped 404 and 409 must be regarded as not running.")
+	}
+	if isNotRunning(fmt.Errorf("connection refused")) {
+		t.Error("Errors other than API errors must not be regarded as not running.")
+	}
+}
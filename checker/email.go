@@ -0,0 +1,328 @@
+package checker
+
+/***
+* This file implements notifier which sends alerts by email via SMTP server.
+* Alerts are sent to addresses in `to` of the config and `authors` in info.json of the challenge.
+* In digest mode, alerts are queued and sent in one message per recipients when the alerter is flushed,
+* which is at the end of each sweep of `CheckAllOnce`, or every `digest_interval` in daemon mode.
+***/
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout of a session with SMTP server.
+const smtpTimeout = 30 * time.Second
+
+// Default window to collect alerts into a digest in daemon mode.
+const defaultDigestInterval = 5 * time.Minute
+
+/***
+* Config of email notifications.
+* @Host, @Port: SMTP server (port defaults to 587, or 465 for `tls`)
+* @Username, @Password: credentials of PLAIN auth (no auth if empty)
+* @TlsMode: `starttls` (default), `tls` (implicit TLS) or `none`
+* @From: sender address
+* @To: addresses always notified (e.g. admins), in addition to authors of challenges
+* @Digest: send alerts of a sweep in one message
+* @DigestInterval: seconds to collect alerts into a digest in daemon mode (default 300)
+***/
+type EmailConfig struct {
+	Host           string   `json:"host"`
+	Port           int      `json:"port"`
+	Username       string   `json:"username"`
+	Password       string   `json:"password"`
+	TlsMode        string   `json:"tls"`
+	From           string   `json:"from"`
+	To             []string `json:"to"`
+	Digest         bool     `json:"digest"`
+	DigestInterval float64  `json:"digest_interval"`
+}
+
+/***
+* Notifier sending an email for each alert.
+* @tls_config: config of TLS connection, which verifies certificate of the server by default
+***/
+type EmailNotifier struct {
+	conf       EmailConfig
+	addr       string
+	tls_config *tls.Config
+}
+
+func NewEmailNotifier(conf EmailConfig) (*EmailNotifier, error) {
+	if len(conf.Host) == 0 {
+		return nil, fmt.Errorf("Host of SMTP server is not specified.")
+	}
+	if _, err := mail.ParseAddress(conf.From); err != nil {
+		return nil, fmt.Errorf("Invalid sender address of email: %s", conf.From)
+	}
+	for _, to := range conf.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return nil, fmt.Errorf("Invalid recipient address of email: %s", to)
+		}
+	}
+
+	port := conf.Port
+	switch conf.TlsMode {
+	case "", "starttls", "none":
+		if port == 0 {
+			port = 587
+		}
+	case "tls":
+		if port == 0 {
+			port = 465
+		}
+	default:
+		return nil, fmt.Errorf("Unknown TLS mode of SMTP: %s", conf.TlsMode)
+	}
+
+	return &EmailNotifier{
+		conf:       conf,
+		addr:       net.JoinHostPort(conf.Host, strconv.Itoa(port)),
+		tls_config: &tls.Config{ServerName: conf.Host},
+	}, nil
+}
+
+func (n *EmailNotifier) String() string {
+	return fmt.Sprintf("email via %s", n.addr)
+}
+
+/***
+* Recipients of the alert: addresses of the config and authors of the challenge, without duplicates.
+***/
+func (n *EmailNotifier) recipients(alert Alert) []string {
+	seen := make(map[string]bool)
+	var recipients []string
+	for _, address := range append(append([]string{}, n.conf.To...), alert.Authors...) {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil || seen[strings.ToLower(parsed.Address)] {
+			continue
+		}
+		seen[strings.ToLower(parsed.Address)] = true
+		recipients = append(recipients, parsed.Address)
+	}
+	return recipients
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, alert Alert) error {
+	recipients := n.recipients(alert)
+	if len(recipients) == 0 {
+		return nil
+	}
+	return n.send(ctx, recipients, alert.title(), emailBody([]Alert{alert}))
+}
+
+/***
+* Plain text of alerts.
+***/
+func emailBody(alerts []Alert) string {
+	var body strings.Builder
+	for i, alert := range alerts {
+		if i != 0 {
+			body.WriteString("\n")
+		}
+		fmt.Fprintf(&body, "%s\n", alert.title())
+		fmt.Fprintf(&body, "  Result:   %s\n", alert.Transition())
+		if len(alert.Error) != 0 {
+			fmt.Fprintf(&body, "  Error:    %s\n", alert.Error)
+		}
+		fmt.Fprintf(&body, "  Attempts: %s\n", alert.attemptsText())
+		fmt.Fprintf(&body, "  Duration: %s\n", alert.durationText())
+		fmt.Fprintf(&body, "  %s\n", alert.footerText())
+		if len(alert.Url) != 0 {
+			fmt.Fprintf(&body, "  Status:   %s\n", alert.Url)
+		}
+		if len(alert.Stderr) != 0 {
+			body.WriteString("  stderr:\n")
+			for _, line := range strings.Split(alert.Stderr, "\n") {
+				fmt.Fprintf(&body, "    %s\n", line)
+			}
+		}
+	}
+	return body.String()
+}
+
+/***
+* Compose message in RFC 5322 with quoted-printable UTF-8 body.
+***/
+func (n *EmailNotifier) message(recipients []string, subject string, body string, now time.Time) []byte {
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", n.conf.From},
+		{"To", strings.Join(recipients, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", "[skbctf-status] "+subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+	return msg.Bytes()
+}
+
+/***
+* Send a message to recipients in a session with SMTP server.
+***/
+func (n *EmailNotifier) send(ctx context.Context, recipients []string, subject string, body string) error {
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	if n.conf.TlsMode == "tls" {
+		conn = tls.Client(conn, n.tls_config)
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, n.conf.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if n.conf.TlsMode == "" || n.conf.TlsMode == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server doesn't support STARTTLS: %s", n.addr)
+		}
+		if err := client.StartTLS(n.tls_config); err != nil {
+			return err
+		}
+	}
+	if len(n.conf.Username) != 0 {
+		// PLAIN auth is refused by net/smtp over unencrypted connection except to localhost
+		if err := client.Auth(smtp.PlainAuth("", n.conf.Username, n.conf.Password, n.conf.Host)); err != nil {
+			return err
+		}
+	}
+
+	from, _ := mail.ParseAddress(n.conf.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(n.message(recipients, subject, body, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+/***
+* Email notifier sending digest of queued alerts.
+***/
+type EmailDigestNotifier struct {
+	*EmailNotifier
+	mu      sync.Mutex
+	pending []Alert
+}
+
+func (n *EmailDigestNotifier) Queue(alert Alert) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = append(n.pending, alert)
+}
+
+/***
+* Subject of digest, such as `2 challenges failing, 1 recovered`.
+***/
+func digestSubject(alerts []Alert) string {
+	if len(alerts) == 1 {
+		return alerts[0].title()
+	}
+	var failing, recovered int
+	for _, alert := range alerts {
+		if alert.Kind == AlertRecovered {
+			recovered++
+		} else {
+			failing++
+		}
+	}
+	var parts []string
+	if failing == 1 {
+		parts = append(parts, "1 challenge failing")
+	} else if failing != 0 {
+		parts = append(parts, fmt.Sprintf("%d challenges failing", failing))
+	}
+	if recovered != 0 {
+		parts = append(parts, fmt.Sprintf("%d recovered", recovered))
+	}
+	return strings.Join(parts, ", ")
+}
+
+/***
+* Send queued alerts. Recipients notified of the same alerts share one message.
+***/
+func (n *EmailDigestNotifier) Flush(ctx context.Context) error {
+	n.mu.Lock()
+	alerts := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+
+	// indices of alerts of each recipient
+	by_recipient := make(map[string][]int)
+	var order []string
+	for i, alert := range alerts {
+		for _, recipient := range n.recipients(alert) {
+			if _, ok := by_recipient[recipient]; !ok {
+				order = append(order, recipient)
+			}
+			by_recipient[recipient] = append(by_recipient[recipient], i)
+		}
+	}
+	groups := make(map[string][]string)
+	var keys []string
+	for _, recipient := range order {
+		key := fmt.Sprint(by_recipient[recipient])
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], recipient)
+	}
+	sort.Strings(keys)
+
+	var errs []string
+	for _, key := range keys {
+		recipients := groups[key]
+		var digest []Alert
+		for _, i := range by_recipient[recipients[0]] {
+			digest = append(digest, alerts[i])
+		}
+		if err := n.send(ctx, recipients, digestSubject(digest), emailBody(digest)); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", recipients, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("Failed to send digest: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
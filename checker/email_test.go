@@ -0,0 +1,298 @@
+package checker
+
+/***
+* This file implements tests of email notifier against a local SMTP stand-in.
+***/
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/***
+* Message received by SMTP stand-in.
+***/
+type smtpMessage struct {
+	tls  bool
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+/***
+* SMTP server which accepts any messages.
+***/
+type smtpStandIn struct {
+	listener   net.Listener
+	tls_config *tls.Config
+	mu         sync.Mutex
+	messages   []smtpMessage
+}
+
+/***
+* Self-signed certificate of 127.0.0.1.
+***/
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func newSmtpStandIn(t *testing.T, cert tls.Certificate) *smtpStandIn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	server := &smtpStandIn{listener: listener, tls_config: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (s *smtpStandIn) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStandIn) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage{}, s.messages...)
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	text := textproto.NewConn(conn)
+	msg := smtpMessage{}
+	text.PrintfLine("220 localhost ESMTP stand-in")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			if msg.tls {
+				text.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			} else {
+				text.PrintfLine("250-localhost\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			tls_conn := tls.Server(conn, s.tls_config)
+			if err := tls_conn.Handshake(); err != nil {
+				return
+			}
+			conn = tls_conn
+			text = textproto.NewConn(conn)
+			msg.tls = true
+		case "AUTH":
+			fields := strings.Fields(line)
+			if len(fields) == 3 {
+				decoded, _ := base64.StdEncoding.DecodeString(fields[2])
+				msg.auth = string(decoded)
+			}
+			text.PrintfLine("235 Authentication successful")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := ioutil.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+/***
+* Parse message, and returns its subject and decoded body.
+***/
+func parseMessage(t *testing.T, data string) (*mail.Message, string) {
+	t.Helper()
+	parsed, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Invalid message: %v\n%s", err, data)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatalf("Invalid body: %v", err)
+	}
+	return parsed, string(body)
+}
+
+func TestEmailNotifier(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	server := newSmtpStandIn(t, cert)
+	conf := EmailConfig{Host: "127.0.0.1", Port: server.port(), Username: "checker", Password: "pass", From: "Status <status@example.com>", To: []string{"admin@example.com"}}
+	notifier, err := NewEmailNotifier(conf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	notifier.tls_config = &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+
+	alert := Alert{Kind: AlertFailing, ChallId: 1, Name: "pwn-1", Result: TestFailure, Status: "Failure", Error: "exit status 1",
+		Stderr: "Traceback:\nEOFError", Failures: 1, Authors: []string{"Author <author@example.com>", "ADMIN@example.com"}}
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Failed to send email: %v", err)
+	}
+
+	received := server.received()
+	if len(received) != 1 {
+		t.Fatalf("Unexpected # of messages: %d", len(received))
+	}
+	msg := received[0]
+	if !msg.tls || msg.auth != "\x00checker\x00pass" || msg.from != "status@example.com" || strings.Join(msg.to, ",") != "admin@example.com,author@example.com" {
+		t.Errorf("Unexpected session: %+v", msg)
+	}
+	parsed, body := parseMessage(t, msg.data)
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subject != "[skbctf-status] pwn-1 is failing" {
+		t.Errorf("Unexpected subject: %s", subject)
+	}
+	if !strings.Contains(body, "Result:   Failure") || !strings.Contains(body, "    EOFError") {
+		t.Errorf("Unexpected body:\n%s", body)
+	}
+
+	// STARTTLS is required by default
+	notifier.tls_config = &tls.Config{ServerName: "127.0.0.1"}
+	if err := notifier.Notify(context.Background(), alert); err == nil {
+		t.Error("Untrusted certificate must be rejected.")
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	server := newSmtpStandIn(t, cert)
+	email, err := NewEmailNotifier(EmailConfig{Host: "127.0.0.1", Port: server.port(), From: "status@example.com", To: []string{"admin@example.com"}, Digest: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	email.tls_config = &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+	alerter := NewAlerterWithNotifiers(*zap.NewNop().Sugar(), 1, []Notifier{&EmailDigestNotifier{EmailNotifier: email}})
+
+	// failures of a sweep
+	alerter.Observe(Challenge{Name: "pwn-1", Id: 1, Result: TestFailure, Authors: []string{"pwn@example.com"}})
+	alerter.Observe(Challenge{Name: "web-1", Id: 2, Result: TestTimeout, Authors: []string{"web@example.com"}})
+	alerter.Observe(Challenge{Name: "misc-1", Id: 3, Result: TestWrongFlag})
+	alerter.Observe(Challenge{Name: "rev-1", Id: 4, Result: TestSuccess, Authors: []string{"rev@example.com"}})
+	if received := server.received(); len(received) != 0 {
+		t.Fatalf("Alerts must be queued until flush: %+v", received)
+	}
+	alerter.Close()
+
+	received := server.received()
+	if len(received) != 3 {
+		t.Fatalf("Unexpected # of messages: %+v", received)
+	}
+	by_recipient := make(map[string]string)
+	for _, msg := range received {
+		if len(msg.to) != 1 {
+			t.Errorf("Recipients notified of different alerts must get different messages: %v", msg.to)
+		}
+		by_recipient[msg.to[0]] = msg.data
+	}
+	parsed, body := parseMessage(t, by_recipient["admin@example.com"])
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subject != "[skbctf-status] 3 challenges failing" {
+		t.Errorf("Unexpected subject of digest: %s", subject)
+	}
+	if !strings.Contains(body, "pwn-1 is failing") || !strings.Contains(body, "web-1 is failing") || !strings.Contains(body, "misc-1 is failing") {
+		t.Errorf("Digest must have all alerts:\n%s", body)
+	}
+	if _, body := parseMessage(t, by_recipient["pwn@example.com"]); strings.Contains(body, "web-1") || !strings.Contains(body, "pwn-1") {
+		t.Errorf("Authors must be notified only of their challenges:\n%s", body)
+	}
+}
+
+func TestDigestSubject(t *testing.T) {
+	failing, recovered := Alert{Kind: AlertFailing, Name: "pwn-1"}, Alert{Kind: AlertRecovered, Name: "web-1"}
+	subjects := map[string][]Alert{
+		"pwn-1 is failing":                 {failing},
+		"1 challenge failing, 1 recovered": {failing, recovered},
+		"2 challenges failing":             {failing, failing},
+		"2 recovered":                      {recovered, recovered},
+	}
+	for expected, alerts := range subjects {
+		if subject := digestSubject(alerts); subject != expected {
+			t.Errorf("Unexpected subject of digest: %s", subject)
+		}
+	}
+}
+
+func TestEmailConfig(t *testing.T) {
+	invalids := []EmailConfig{
+		{From: "status@example.com"},
+		{Host: "smtp.example.com", From: "not an address"},
+		{Host: "smtp.example.com", From: "status@example.com", To: []string{"@"}},
+		{Host: "smtp.example.com", From: "status@example.com", TlsMode: "ssl3"},
+	}
+	for _, conf := range invalids {
+		if _, err := NewEmailNotifier(conf); err == nil {
+			t.Errorf("Invalid config must be rejected: %+v", conf)
+		}
+	}
+	if notifier, err := NewEmailNotifier(EmailConfig{Host: "smtp.example.com", From: "status@example.com", TlsMode: "tls"}); err != nil || notifier.addr != "smtp.example.com:465" {
+		t.Errorf("Unexpected default port: %v, %v", notifier, err)
+	}
+}
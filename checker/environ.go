@@ -0,0 +1,85 @@
+package checker
+
+/***
+* This file implements connection information passed to solver containers.
+* Solvers receive them as environment variables, so that the same solver image works against any deployment:
+*		- CHALL_HOST: host of the challenge server
+*		- CHALL_PORT: port of the challenge server
+*		- other entries declared in `env`
+* `args` are passed to solver as command-line arguments, where `$VAR` is expanded with the environment variables above.
+***/
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+/***
+* Fill connection information and resource limits of the challenge with global defaults of checker.
+* Values declared in info.json take priority over defaults.
+***/
+func (chall *Challenge) applyDefaults(conf CheckerConfig) {
+	if len(chall.Host) == 0 {
+		chall.Host = conf.Host
+	}
+	if chall.Port == 0 {
+		chall.Port = conf.Port
+	}
+
+	env := make(map[string]string)
+	for key, value := range conf.Env {
+		env[key] = value
+	}
+	for key, value := range chall.Env {
+		env[key] = value
+	}
+	chall.Env = env
+
+	chall.ResourceLimits.merge(conf.ResourceLimits)
+}
+
+/***
+* Environment variables passed to solver.
+***/
+func (chall *Challenge) envMap() map[string]string {
+	env := make(map[string]string)
+	for key, value := range chall.Env {
+		env[key] = value
+	}
+	if len(chall.Host) != 0 {
+		env["CHALL_HOST"] = chall.Host
+	}
+	if chall.Port != 0 {
+		env["CHALL_PORT"] = strconv.Itoa(chall.Port)
+	}
+	return env
+}
+
+/***
+* Environment variables passed to solver in `KEY=VALUE` form, sorted by key.
+***/
+func (chall *Challenge) Environ() []string {
+	env := chall.envMap()
+	environ := make([]string, 0, len(env))
+	for key, value := range env {
+		environ = append(environ, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(environ)
+	return environ
+}
+
+/***
+* Command-line arguments passed to solver, with environment variables expanded.
+***/
+func (chall *Challenge) CommandArgs() []string {
+	env := chall.envMap()
+	args := make([]string, 0, len(chall.Args))
+	for _, arg := range chall.Args {
+		args = append(args, os.Expand(arg, func(key string) string {
+			return env[key]
+		}))
+	}
+	return args
+}
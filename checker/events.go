@@ -0,0 +1,155 @@
+package checker
+
+/***
+* This file implements notifications of test results.
+* `Hub` delivers events to its subscribers, and `Watch` feeds it by polling a result store,
+* so that a server in another process than checker can notice new results.
+* Events are:
+*		- result: a new result of a challenge is recorded
+*		- state: a challenge went up or down, which follows the result event causing it
+***/
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// # of events buffered for each subscriber. Events to a subscriber with full buffer are dropped.
+const eventBufferSize = 64
+
+var stateNames = map[challState]string{
+	stateUnknown: "unknown",
+	stateUp:      "up",
+	stateDown:    "down",
+}
+
+/***
+* Notification of a test result.
+* @Type: `result` or `state`
+* @State, @PreviousState: state of the challenge after and before the result (`up`, `down` or `unknown`)
+***/
+type Event struct {
+	Type          string   `json:"type"`
+	Result        DbResult `json:"result"`
+	Status        string   `json:"status"`
+	State         string   `json:"state"`
+	PreviousState string   `json:"previous_state"`
+}
+
+/***
+* Broadcaster of events.
+***/
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[chan Event]struct{})}
+}
+
+/***
+* Subscribe events. Call returned function to unsubscribe, which closes the channel.
+***/
+func (hub *Hub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	hub.mu.Lock()
+	hub.subscribers[ch] = struct{}{}
+	hub.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			hub.mu.Lock()
+			delete(hub.subscribers, ch)
+			hub.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+/***
+* Deliver the event to all subscribers without blocking.
+***/
+func (hub *Hub) Publish(event Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+/***
+* Latest result and known state of each challenge seen by watcher.
+***/
+type watchState struct {
+	latest map[int]DbResult
+	states map[int]challState
+}
+
+/***
+* Publish events of results recorded since the last poll.
+* Only the latest result of each challenge is noticed, so results recorded between polls may be skipped.
+* The first poll only learns current results.
+***/
+func (hub *Hub) poll(store ResultStore, ws *watchState) error {
+	latest, err := store.FetchLatestResults()
+	if err != nil {
+		return err
+	}
+	first := ws.latest == nil
+	if first {
+		ws.latest = make(map[int]DbResult)
+		ws.states = make(map[int]challState)
+	}
+
+	for _, result := range latest {
+		last, seen := ws.latest[result.ChallId]
+		if seen && last.Timestamp.Equal(result.Timestamp) && last.RunId == result.RunId {
+			continue
+		}
+		ws.latest[result.ChallId] = result
+
+		previous := ws.states[result.ChallId]
+		state := result.Result.state()
+		if state != stateUnknown {
+			ws.states[result.ChallId] = state
+		}
+		if first {
+			continue
+		}
+
+		event := Event{Type: "result", Result: result, Status: result.Result.ToMessage(), State: stateNames[state], PreviousState: stateNames[previous]}
+		hub.Publish(event)
+		if state != stateUnknown && state != previous {
+			event.Type = "state"
+			hub.Publish(event)
+		}
+	}
+	return nil
+}
+
+/***
+* Poll the store every `interval` and publish events until `ctx` is done.
+***/
+func (hub *Hub) Watch(ctx context.Context, logger zap.SugaredLogger, store ResultStore, interval time.Duration) {
+	ws := watchState{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := hub.poll(store, &ws); err != nil {
+			logger.Warnf("Failed to poll test results: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package checker
+
+/***
+* This file implements tests of notifications of test results.
+***/
+
+import (
+	"testing"
+)
+
+func TestHubPoll(t *testing.T) {
+	store := NewMemoryStore()
+	hub := NewHub()
+	events, unsubscribe := hub.Subscribe()
+	ws := watchState{}
+
+	// receive events published by a poll
+	receive := func() []Event {
+		t.Helper()
+		if err := hub.poll(store, &ws); err != nil {
+			t.Fatalf("Failed to poll: %v", err)
+		}
+		var received []Event
+		for {
+			select {
+			case event := <-events:
+				received = append(received, event)
+			default:
+				return received
+			}
+		}
+	}
+	record := func(challid int, result TestResult) {
+		t.Helper()
+		if err := store.RecordResult(Challenge{Name: "events", Id: challid, Result: result}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// first poll only learns current results
+	record(1, TestFailure)
+	if received := receive(); len(received) != 0 {
+		t.Errorf("First poll must not publish events: %+v", received)
+	}
+
+	// recovery
+	record(1, TestSuccess)
+	received := receive()
+	if len(received) != 2 || received[0].Type != "result" || received[1].Type != "state" {
+		t.Fatalf("Result and state events must be published: %+v", received)
+	}
+	if received[1].State != "up" || received[1].PreviousState != "down" || received[1].Status != "Success" || received[1].Result.ChallId != 1 {
+		t.Errorf("Unexpected state event: %+v", received[1])
+	}
+
+	// nothing new, same state, and unknown state
+	if received := receive(); len(received) != 0 {
+		t.Errorf("Events must not be published without new results: %+v", received)
+	}
+	record(1, TestSuccess)
+	if received := receive(); len(received) != 1 || received[0].Type != "result" {
+		t.Errorf("Only result event must be published: %+v", received)
+	}
+	record(1, TestInfraError)
+	if received := receive(); len(received) != 1 || received[0].State != "unknown" || received[0].PreviousState != "up" {
+		t.Errorf("Infra error must not change state: %+v", received)
+	}
+
+	// new challenge going down
+	record(2, TestTimeout)
+	received = receive()
+	if len(received) != 2 || received[1].State != "down" || received[1].PreviousState != "unknown" {
+		t.Errorf("Unexpected events of new challenge: %+v", received)
+	}
+
+	// unsubscribed channel is closed, and publishing doesn't block
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Error("Channel must be closed after unsubscribed.")
+	}
+	hub.Publish(Event{Type: "result"})
+}
+
+func TestHubDropsSlowSubscriber(t *testing.T) {
+	hub := NewHub()
+	events, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+	for i := 0; i < eventBufferSize*2; i++ {
+		hub.Publish(Event{Type: "result"})
+	}
+	if len(events) != eventBufferSize {
+		t.Errorf("Events beyond buffer must be dropped: %d", len(events))
+	}
+}
@@ -6,15 +6,12 @@ package checker
 ***/
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
-	"os/signal"
 	"path/filepath"
-	"syscall"
 	"time"
 
 	"go.uber.org/zap"
@@ -25,12 +22,24 @@ import (
 * @path: path to challenge directory
 * @retry_max: maximum # of execution retry
 * @try_current: # of executed try
+* @infra_current: # of tries failed due to infra error
+* @runner: backend to build and run solvers
+* @run_id: ID of the run this test belongs to
+* @log_dir: directory to persist solver outputs. Outputs are not persisted if empty.
+* @conf: config of checker, which holds defaults of challenges
+* @infra_backoff: wait before the first retry of infra error, which doubles on every retry. No wait if zero.
 ***/
 type Executer struct {
-	path        string
-	logger      zap.SugaredLogger
-	retry_max   uint
-	try_current uint
+	path          string
+	logger        zap.SugaredLogger
+	retry_max     uint
+	try_current   uint
+	infra_current uint
+	runner        Runner
+	run_id        string
+	log_dir       string
+	conf          CheckerConfig
+	infra_backoff time.Duration
 }
 
 /***
@@ -39,17 +48,66 @@ type Executer struct {
 * @Name: challenge name
 * @Id: challenge ID
 * @Default_success: if test is not executed due to insufficient info, result becomes `Success` if this is true.
+* @Flag: flag which solver must print to stdout to succeed
+* @FlagRegex: regular expression of flag which solver must print to stdout to succeed
+* @FlagFile: path to file containing flag, relative to challenge directory
+* @Host: host of the challenge server, passed to solver as `CHALL_HOST`
+* @Port: port of the challenge server, passed to solver as `CHALL_PORT`
+* @Env: additional environment variables passed to solver
+* @Args: command-line arguments passed to solver
+* @ResourceLimits: resource limits and network policy of solver container
+* @Interval: interval of checks in minutes, which overrides `interval` of checker
+* @Cron: cron expression of check schedule, which takes priority over `Interval`
 * @Result: test result
+* @BuildTime: time taken to build solver image
+* @RunTime: time taken to run solver in the last try
+* @Attempts: # of tries solver is run
+* @MaxAttempts: max # of tries allowed, including retries
+* @RunId: ID of the run this test belongs to
+* @ExitCode: exit code of solver in the last try, or -1 if it didn't exit by itself
+* @Error: reason of failure in the last try (empty on success)
+* @Stdout: stdout of solver in the last try (tail of it if too long)
+* @Stderr: stderr of solver in the last try, or build error (tail of it if too long)
 ***/
 type Challenge struct {
-	Name             string  `json:"name"`
-	Id               int     `json:"id"`
-	Default_success  bool    `json:"default"`
-	Timeout          float64 `json:"timeout"`
+	Name            string            `json:"name"`
+	Id              int               `json:"id"`
+	Category        string            `json:"category"`
+	Authors         []string          `json:"authors"`
+	Default_success bool              `json:"default"`
+	Timeout         float64           `json:"timeout"`
+	Flag            string            `json:"flag"`
+	FlagRegex       string            `json:"flag_regex"`
+	FlagFile        string            `json:"flag_file"`
+	Host            string            `json:"host"`
+	Port            int               `json:"port"`
+	Env             map[string]string `json:"env"`
+	Args            []string          `json:"args"`
+	ResourceLimits
+	Interval         float64 `json:"interval"`
+	Cron             string  `json:"cron"`
 	Exploit_dir_name string
 	Result           TestResult
+	BuildTime        time.Duration `json:"-"`
+	RunTime          time.Duration `json:"-"`
+	Attempts         uint          `json:"-"`
+	MaxAttempts      uint          `json:"-"`
+	RunId            string        `json:"-"`
+	ExitCode         int           `json:"-"`
+	Error            string        `json:"-"`
+	Stdout           string        `json:"-"`
+	Stderr           string        `json:"-"`
 }
 
+// Time to wait for solver to exit after it's killed.
+const killWaitTime = 10 * time.Second
+
+// Wait before the first retry of infra error, and the max of it.
+const (
+	infraRetryBackoff    = 2 * time.Second
+	maxInfraRetryBackoff = 30 * time.Second
+)
+
 /***
 * Test result.
 ***/
@@ -66,6 +124,14 @@ const (
 	TestNotExecuted
 	// Test is failure
 	TestFailure
+	// Solver image couldn't be built
+	TestBuildFailure
+	// Test couldn't be executed due to runner failure, such as unreachable Docker daemon
+	TestInfraError
+	// Solver exited successfully, but didn't print the expected flag
+	TestWrongFlag
+	// Test was aborted due to shutdown of checker
+	TestAborted
 )
 
 func (tr TestResult) String() string {
@@ -80,6 +146,14 @@ func (tr TestResult) String() string {
 		return "TestFailure"
 	case TestSuccessWithoutExecution:
 		return "TestSuccessWithoutExecution"
+	case TestBuildFailure:
+		return "TestBuildFailure"
+	case TestInfraError:
+		return "TestInfraError"
+	case TestWrongFlag:
+		return "TestWrongFlag"
+	case TestAborted:
+		return "TestAborted"
 	default:
 		return "UnknownFailure"
 	}
@@ -95,6 +169,14 @@ func (tr TestResult) ToMessage() string {
 		return "test not executed"
 	case TestFailure:
 		return "Failure"
+	case TestBuildFailure:
+		return "Build Failure"
+	case TestInfraError:
+		return "Infra Error"
+	case TestWrongFlag:
+		return "Wrong Flag"
+	case TestAborted:
+		return "Aborted"
 	default:
 		return "UnknownFailure"
 	}
@@ -112,35 +194,60 @@ func (tr TestResult) ToColor() string {
 		return "808080"
 	case TestFailure:
 		return "CC0000"
+	case TestBuildFailure:
+		return "FF8000"
+	case TestInfraError:
+		return "B0A000"
+	case TestWrongFlag:
+		return "CC3366"
+	case TestAborted:
+		return "A0A0A0"
 	default:
 		return "202020"
 	}
 }
 
 /***
-* Check challenge directory and collect challenge information to check whether test can be executed.
+* Read and parse info file of challenge.
 ***/
-func (e *Executer) prepare_check(infofile string) (Challenge, error) {
-	ret := TestNotExecuted
-
-	// read config file
-	cfg_file_name := filepath.Join(e.path, infofile)
-	cfg_file, err := os.Open(cfg_file_name)
-	if err != nil {
-		return Challenge{Result: ret}, fmt.Errorf("%s not found in %s.", infofile, e.path)
+func readChallengeInfo(challdir string, infofile string) (Challenge, error) {
+	cfg_file_name := filepath.Join(challdir, infofile)
+	if _, err := os.Stat(cfg_file_name); err != nil {
+		return Challenge{}, fmt.Errorf("%s not found in %s.", infofile, challdir)
 	}
-	cfg_bytes, err := ioutil.ReadAll(cfg_file)
+	cfg_bytes, err := ioutil.ReadFile(cfg_file_name)
 	if err != nil {
-		return Challenge{Result: ret}, fmt.Errorf("Failed to read config file %s.", cfg_file_name)
+		return Challenge{}, fmt.Errorf("Failed to read config file %s.", cfg_file_name)
 	}
 
 	var chall Challenge
 	if err := json.Unmarshal(cfg_bytes, &chall); err != nil {
-		return Challenge{Result: ret}, fmt.Errorf("Failed to parse %s as JSON:\n%v", cfg_file_name, err)
+		return Challenge{}, fmt.Errorf("Failed to parse %s as JSON:\n%v", cfg_file_name, err)
+	}
+	return chall, nil
+}
+
+/***
+* Check challenge directory and collect challenge information to check whether test can be executed.
+***/
+func (e *Executer) prepare_check(infofile string) (Challenge, error) {
+	ret := TestNotExecuted
+
+	// read config file
+	chall, err := readChallengeInfo(e.path, infofile)
+	if err != nil {
+		return Challenge{Result: ret}, err
 	}
 	if chall.Default_success {
 		ret = TestSuccessWithoutExecution
 	}
+	chall.applyDefaults(e.conf)
+
+	// read expected flag
+	if err := chall.prepareFlag(e.path); err != nil {
+		chall.Result = ret
+		return chall, err
+	}
 
 	// check exploit path and Dockerfile
 	chall.Exploit_dir_name = filepath.Join(e.path, "exploit")
@@ -165,108 +272,251 @@ func (e *Executer) prepare_check(infofile string) (Challenge, error) {
 	return chall, nil
 }
 
+/***
+* Build solver image of the challenge and measure build time.
+* On failure, result of the challenge is set to `TestBuildFailure`, or `TestInfraError` if runner itself is unavailable.
+* If ctx is cancelled, build is aborted.
+***/
+func (e *Executer) build(ctx context.Context, chall *Challenge) (string, error) {
+	start_time := time.Now()
+	image, err := e.getRunner().Build(ctx, *chall)
+	chall.BuildTime = time.Since(start_time)
+
+	if err != nil {
+		chall.Stdout = ""
+		chall.Stderr = err.Error()
+		chall.Error = err.Error()
+		if len(chall.Stderr) > MaxOutputSize {
+			chall.Stderr = chall.Stderr[len(chall.Stderr)-MaxOutputSize:]
+		}
+		if ctx.Err() != nil {
+			e.logger.Infof("[%s] Build aborted.", chall.Name)
+			chall.Result = TestAborted
+		} else if IsInfraError(err) {
+			e.logger.Warnf("[%s] Runner is unavailable: \n%v", chall.Name, err)
+			chall.Result = TestInfraError
+		} else {
+			e.logger.Warnf("[%s] Failed to build solver: \n%v", chall.Name, err)
+			chall.Result = TestBuildFailure
+		}
+		return "", err
+	}
+
+	e.logger.Infof("[%s] Solver built in %v.", chall.Name, chall.BuildTime)
+	return image, nil
+}
+
 /***
 * Do execute test and return result via `res_chan` channel.
 * This function receives channel for kill signal for timeout.
+* If ctx is cancelled, solver is killed and the result becomes `TestAborted`.
 ***/
-func (e *Executer) execute_internal(res_chan chan Challenge, chall Challenge, killer_chan <-chan bool) {
-	// prepare command
+func (e *Executer) execute_internal(ctx context.Context, res_chan chan Challenge, chall Challenge, image string, killer_chan <-chan bool) {
+	runner := e.getRunner()
 	container_name := fmt.Sprintf("container_solver_%d_%d", chall.Id, time.Now().Unix())
-	image_name := fmt.Sprintf("solver_%d", chall.Id)
-	cmd := exec.Command("bash", "-c", fmt.Sprintf("docker run --name %s --rm $(docker build -qt solver_%s %s)", container_name, image_name, chall.Exploit_dir_name))
-
-	// termination signal hook
-	signal_chan := make(chan os.Signal, 1)
-	signal.Notify(signal_chan, os.Interrupt, syscall.SIGTERM)
 
 	// execute test async
-	if err := cmd.Start(); err != nil {
-		e.logger.Warnf("[%s] Failed to start test: \n%w", chall.Name, err)
-		chall.Result = TestFailure
-		res_chan <- chall
-		return
+	type run_result struct {
+		exit_code int
+		err       error
 	}
-	e.logger.Infof("[%s] Test started as pid %d in %s.", chall.Name, cmd.Process.Pid, container_name)
-
-	res_chan_internal := make(chan error)
-	var errbuf bytes.Buffer
-	cmd.Stderr = &errbuf
-	go func() {
-		res_chan_internal <- cmd.Wait()
-	}()
+	res_chan_internal := make(chan run_result, 1)
+	stdout := newTailBuffer(MaxOutputSize)
+	stderr := newTailBuffer(MaxOutputSize)
+	chall.Attempts++
+	start_time := time.Now()
+	go func(chall Challenge) {
+		exit_code, err := runner.Run(ctx, chall, image, container_name, stdout, stderr)
+		res_chan_internal <- run_result{exit_code: exit_code, err: err}
+	}(chall)
+	e.logger.Infof("[%s] Test started in %s.", chall.Name, container_name)
 
 	shutdown_hook := func() {
-		// remove container
-		if err := exec.Command("docker", "rm", "-f", container_name).Run(); err != nil {
-			e.logger.Warnf("Failed to remove container(%s):\n%v", container_name, err)
+		// kill container, and wait a while to collect outputs until then
+		if err := runner.Kill(container_name); err != nil {
+			e.logger.Warnf("Failed to kill container(%s):\n%v", container_name, err)
+		}
+		select {
+		case <-res_chan_internal:
+		case <-time.After(killWaitTime):
 		}
-		// kill process
-		if err := cmd.Process.Kill(); err != nil {
-			e.logger.Warnf("Failed to kill process: %v", err)
+		// remove container
+		if err := runner.Cleanup(container_name); err != nil {
+			e.logger.Warnf("%v", err)
 		}
+		chall.RunTime = time.Since(start_time)
+		chall.Stdout = stdout.String()
+		chall.Stderr = stderr.String()
+		chall.redactFlag()
 		res_chan <- chall
 	}
 
 	// wait and get exit-status
 	select {
-	case <-signal_chan: // process terminated
-		e.logger.Info("Process terminated, cleaning up docker container...")
+	case <-ctx.Done(): // checker is shutting down
+		e.logger.Infof("[%s] Test aborted, cleaning up docker container...", chall.Name)
+		chall.Result = TestAborted
+		chall.ExitCode = -1
+		chall.Error = "aborted by shutdown of checker"
 		shutdown_hook()
-		os.Exit(0)
 	case _, ok := <-killer_chan: // timeout
 		if !ok {
 			shutdown_hook()
 		}
 		break
-	case err := <-res_chan_internal: // test execution end
-		if err != nil {
-			if exiterr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					exit_code := status.ExitStatus()
-					e.logger.Infof("[%s] Test failed with status %d.\n%v", chall.Name, exit_code, err)
-					e.logger.Infof("%v", errbuf.String())
-					chall.Result = TestFailure
-					res_chan <- chall
-					return
-				}
+	case res := <-res_chan_internal: // test execution end
+		chall.RunTime = time.Since(start_time)
+		chall.Stdout = stdout.String()
+		chall.Stderr = stderr.String()
+		chall.ExitCode = res.exit_code
+		chall.Error = ""
+		if err := runner.Cleanup(container_name); err != nil {
+			e.logger.Warnf("%v", err)
+		}
+		if res.err != nil {
+			chall.Error = res.err.Error()
+			e.logger.Warnf("[%s] Failed to run test: \n%v", chall.Name, res.err)
+			if IsInfraError(res.err) {
+				chall.Result = TestInfraError
+			} else {
+				chall.Result = TestFailure
 			}
+		} else if res.exit_code != 0 {
+			e.logger.Infof("[%s] Test failed with status %d.", chall.Name, res.exit_code)
+			chall.Error = fmt.Sprintf("exit status %d", res.exit_code)
+			chall.Result = TestFailure
+		} else if !chall.verifyFlag(chall.Stdout) {
+			e.logger.Infof("[%s] exits with status code 0, but flag is not found in stdout.", chall.Name)
+			chall.Error = "flag not found in stdout"
+			chall.Result = TestWrongFlag
 		} else {
 			// command ends without any failure
-			e.logger.Infof("[%s] exits with status code 0.", chall.Name)
+			e.logger.Infof("[%s] exits with status code 0 in %v.", chall.Name, chall.RunTime)
 			chall.Result = TestSuccess
-			res_chan <- chall
 		}
+		chall.redactFlag()
+		res_chan <- chall
 	}
 }
 
+/***
+* Fill information of this execution into the challenge.
+***/
+func (e *Executer) annotate(chall *Challenge) {
+	chall.RunId = e.run_id
+	chall.MaxAttempts = e.retry_max + 1
+	chall.ExitCode = -1
+}
+
+/***
+* Persist outputs of the last try if log directory is specified.
+***/
+func (e *Executer) record_log(chall Challenge) {
+	if len(e.log_dir) == 0 || len(e.run_id) == 0 {
+		return
+	}
+	if err := WriteRunLog(e.log_dir, e.run_id, chall); err != nil {
+		e.logger.Warnf("[%s] Failed to write solver outputs: %v", chall.Name, err)
+	}
+}
+
+/***
+* Get Runner of this executer.
+* It defaults to Docker CLI runner if no runner is specified.
+***/
+func (e *Executer) getRunner() Runner {
+	if e.runner == nil {
+		e.runner = NewDockerCliRunner()
+	}
+	return e.runner
+}
+
+/***
+* Decide whether a test should be retried, and count up the number of tries.
+* Infra errors are not counted as tries of solvers, but they are retried at most `retry_max` times too.
+* Infra errors are retried after backoff, so that unavailable runner is not hammered. It's not retried if ctx is cancelled meanwhile.
+* Aborted tests are never retried.
+***/
+func (e *Executer) should_retry(ctx context.Context, chall Challenge) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch chall.Result {
+	case TestSuccess, TestSuccessWithoutExecution, TestAborted:
+		return false
+	case TestInfraError:
+		e.infra_current++
+		if e.infra_current > e.retry_max {
+			return false
+		}
+		if backoff := e.infraBackoff(); backoff > 0 {
+			e.logger.Infof("[%s] Runner is unavailable, retrying in %v...", chall.Name, backoff)
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(backoff):
+			}
+		}
+	default:
+		e.try_current++
+		if e.try_current > e.retry_max {
+			return false
+		}
+	}
+
+	e.logger.Infof("[%s] Retrying test...", chall.Name)
+	return true
+}
+
+/***
+* Wait before the current retry of infra error, which doubles on every retry up to `maxInfraRetryBackoff`.
+***/
+func (e *Executer) infraBackoff() time.Duration {
+	backoff := e.infra_backoff
+	for i := uint(1); i < e.infra_current && backoff < maxInfraRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxInfraRetryBackoff {
+		return maxInfraRetryBackoff
+	}
+	return backoff
+}
+
 /***
 *	execute tests w/o timeout.
 *	it retries execution for specified times if a test fails.
+*	if ctx is cancelled, running test is aborted.
 ***/
-func (e *Executer) Check(res_chan chan<- Challenge, infofile string) {
+func (e *Executer) Check(ctx context.Context, res_chan chan<- Challenge, infofile string) {
 	// read config file and check target directry structure
 	chall, err := e.prepare_check(infofile)
+	e.annotate(&chall)
 	if err != nil {
 		e.logger.Infof("%v", err)
+		chall.Error = err.Error()
 		res_chan <- chall
 		return
 	}
 
 	// execute test
+	image := ""
 	for e.try_current <= e.retry_max {
-		res_chan_internal := make(chan Challenge)
-		killer_chan := make(chan bool)
-		go e.execute_internal(res_chan_internal, chall, killer_chan)
-		chall = <-res_chan_internal
+		// build solver image, which is reused for retries
+		if len(image) == 0 {
+			image, _ = e.build(ctx, &chall)
+		}
+		if len(image) != 0 {
+			res_chan_internal := make(chan Challenge)
+			killer_chan := make(chan bool)
+			go e.execute_internal(ctx, res_chan_internal, chall, image, killer_chan)
+			chall = <-res_chan_internal
+		}
+		e.record_log(chall)
 
 		// retry a test or return result
-		if chall.Result == TestSuccess || chall.Result == TestSuccessWithoutExecution {
+		if !e.should_retry(ctx, chall) {
 			break
 		}
-		if e.try_current < e.retry_max {
-			e.logger.Infof("[%s] Retrying test...", chall.Name)
-		}
-		e.try_current++
 	}
 
 	res_chan <- chall
@@ -275,12 +525,16 @@ func (e *Executer) Check(res_chan chan<- Challenge, infofile string) {
 /***
 *	execute tests with timeout.
 *	it retries execution for specified times if a test fails.
+*	timeout is applied only to run phase of solvers.
+*	if ctx is cancelled, running test is aborted.
 ***/
-func (e *Executer) CheckWithTimeout(res_chan chan<- Challenge, infofile string, timeout float64) {
+func (e *Executer) CheckWithTimeout(ctx context.Context, res_chan chan<- Challenge, infofile string, timeout float64) {
 	// read config file and check target directry structure
 	chall, err := e.prepare_check(infofile)
+	e.annotate(&chall)
 	if err != nil {
 		e.logger.Infof("%v", err)
+		chall.Error = err.Error()
 		res_chan <- chall
 		return
 	}
@@ -293,31 +547,42 @@ func (e *Executer) CheckWithTimeout(res_chan chan<- Challenge, infofile string,
 	e.logger.Infof("[%s] timeout set to %f.", chall.Name, timeout)
 
 	// execute test some times
+	image := ""
 	for e.try_current <= e.retry_max {
-		res_chan_internal := make(chan Challenge)
-		killer_chan := make(chan bool)
-		go e.execute_internal(res_chan_internal, chall, killer_chan)
-
-		// wait end of execution, or kill process for timeout.
-		select {
-		case result := <-res_chan_internal:
-			chall = result
-			break
-		case <-time.After(time.Duration(timeout) * time.Second):
-			close(killer_chan)
-			chall = <-res_chan_internal
-			chall.Result = TestTimeout
-			break
+		// build solver image, which is reused for retries
+		if len(image) == 0 {
+			image, _ = e.build(ctx, &chall)
+		}
+		if len(image) != 0 {
+			res_chan_internal := make(chan Challenge)
+			killer_chan := make(chan bool)
+			go e.execute_internal(ctx, res_chan_internal, chall, image, killer_chan)
+
+			// wait end of execution, or kill process for timeout.
+			// timeout is disabled if it's not positive.
+			var timeout_chan <-chan time.Time
+			if timeout > 0 {
+				timeout_chan = time.After(time.Duration(timeout) * time.Second)
+			}
+			select {
+			case result := <-res_chan_internal:
+				chall = result
+				break
+			case <-timeout_chan:
+				close(killer_chan)
+				chall = <-res_chan_internal
+				chall.Result = TestTimeout
+				chall.ExitCode = -1
+				chall.Error = fmt.Sprintf("timed out after %vs", timeout)
+				break
+			}
 		}
+		e.record_log(chall)
 
 		// retry a test or return result
-		if chall.Result == TestSuccess || chall.Result == TestSuccessWithoutExecution {
+		if !e.should_retry(ctx, chall) {
 			break
 		}
-		if e.try_current < e.retry_max {
-			e.logger.Infof("[%s] Retrying test...", chall.Name)
-		}
-		e.try_current++
 	}
 
 	res_chan <- chall
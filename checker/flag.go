@@ -0,0 +1,84 @@
+package checker
+
+/***
+* This file implements verification of flags printed by solvers.
+* Expected flag is declared in info.json by one of:
+*		- `flag`: literal flag
+*		- `flag_regex`: regular expression of flag
+*		- `flag_file`: path to file containing literal flag
+* If none of them is declared, exit code of solver solely decides the result.
+***/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const redactedFlag = "[REDACTED FLAG]"
+
+/***
+* Read flag file and check regular expression of flag.
+* `challdir` is a base directory of relative flag file path.
+***/
+func (chall *Challenge) prepareFlag(challdir string) error {
+	if len(chall.FlagFile) != 0 && len(chall.Flag) == 0 {
+		flag_file_name := chall.FlagFile
+		if !filepath.IsAbs(flag_file_name) {
+			flag_file_name = filepath.Join(challdir, flag_file_name)
+		}
+		flag_bytes, err := ioutil.ReadFile(flag_file_name)
+		if err != nil {
+			return fmt.Errorf("[%s] Failed to read flag file: %v", chall.Name, err)
+		}
+		chall.Flag = strings.TrimSpace(string(flag_bytes))
+		if len(chall.Flag) == 0 {
+			return fmt.Errorf("[%s] Flag file is empty: %s", chall.Name, flag_file_name)
+		}
+	}
+
+	if len(chall.FlagRegex) != 0 {
+		if _, err := regexp.Compile(chall.FlagRegex); err != nil {
+			return fmt.Errorf("[%s] Invalid flag regex: %v", chall.Name, err)
+		}
+	}
+
+	return nil
+}
+
+/***
+* Check whether solver printed expected flag.
+* It always returns true if no flag is declared.
+***/
+func (chall *Challenge) verifyFlag(stdout string) bool {
+	if len(chall.Flag) != 0 && !strings.Contains(stdout, chall.Flag) {
+		return false
+	}
+	if len(chall.FlagRegex) != 0 {
+		if re, err := regexp.Compile(chall.FlagRegex); err != nil || !re.MatchString(stdout) {
+			return false
+		}
+	}
+	return true
+}
+
+/***
+* Remove flags from outputs of solver, because outputs are persisted and published.
+***/
+func (chall *Challenge) redactFlag() {
+	redact := func(s string) string {
+		if len(chall.Flag) != 0 {
+			s = strings.ReplaceAll(s, chall.Flag, redactedFlag)
+		}
+		if len(chall.FlagRegex) != 0 {
+			if re, err := regexp.Compile(chall.FlagRegex); err == nil {
+				s = re.ReplaceAllLiteralString(s, redactedFlag)
+			}
+		}
+		return s
+	}
+	chall.Stdout = redact(chall.Stdout)
+	chall.Stderr = redact(chall.Stderr)
+}
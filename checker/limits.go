@@ -0,0 +1,48 @@
+package checker
+
+/***
+* This file defines resource limits and network policy of solver containers.
+* They can be declared both in info.json of each challenge and in checker config as defaults.
+***/
+
+/***
+* Resource limits and network policy of solver containers.
+* Zero values mean no limit.
+* @Memory: memory limit in MiB (swap is not allowed beyond it)
+* @Cpus: number of CPUs solver can use (e.g. 0.5)
+* @Pids: max number of processes in container
+* @ReadOnly: mount root filesystem as read-only. `/tmp` is still writable as tmpfs.
+* @Network: name of Docker network container attaches to
+***/
+type ResourceLimits struct {
+	Memory   int64   `json:"memory"`
+	Cpus     float64 `json:"cpus"`
+	Pids     int64   `json:"pids"`
+	ReadOnly *bool   `json:"readonly"`
+	Network  string  `json:"network"`
+}
+
+/***
+* Fill unspecified limits with defaults.
+***/
+func (l *ResourceLimits) merge(defaults ResourceLimits) {
+	if l.Memory == 0 {
+		l.Memory = defaults.Memory
+	}
+	if l.Cpus == 0 {
+		l.Cpus = defaults.Cpus
+	}
+	if l.Pids == 0 {
+		l.Pids = defaults.Pids
+	}
+	if l.ReadOnly == nil {
+		l.ReadOnly = defaults.ReadOnly
+	}
+	if len(l.Network) == 0 {
+		l.Network = defaults.Network
+	}
+}
+
+func (l ResourceLimits) isReadOnly() bool {
+	return l.ReadOnly != nil && *l.ReadOnly
+}
@@ -5,6 +5,7 @@ package checker
 ***/
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -30,7 +31,7 @@ func TestBlockingExecute(t *testing.T) {
 			res := make(chan Challenge, 1)
 			abspath, _ := filepath.Abs(filepath.Join("../examples", f.Name()))
 			executer := Executer{path: abspath, logger: *slogger}
-			executer.Check(res, "info.json")
+			executer.Check(context.Background(), res, "info.json")
 			chall := <-res
 			slogger.Infof("Result: %v", chall.Result)
 
@@ -68,7 +69,7 @@ func TestBlockingAllCheck(t *testing.T) {
 	}
 
 	start_time := time.Now().Unix()
-	if err := CheckAllOnce(*slogger, conf); err != nil {
+	if _, err := CheckAllOnce(context.Background(), *slogger, conf); err != nil {
 		t.Errorf("Test failed: %v", err)
 	}
 	end_time := time.Now().Unix()
@@ -89,7 +90,7 @@ func TestAsyncAllCheck(t *testing.T) {
 	}
 
 	start_time := time.Now().Unix()
-	if err := CheckAllOnce(*slogger, conf); err != nil {
+	if _, err := CheckAllOnce(context.Background(), *slogger, conf); err != nil {
 		t.Errorf("Test failed: %v", err)
 	}
 	end_time := time.Now().Unix()
@@ -118,7 +119,7 @@ func TestRecordCheckAllOnce(t *testing.T) {
 	os.Setenv("DBHOST", dbhost)
 
 	start_time := time.Now().Unix()
-	if err := CheckAllOnce(*slogger, conf); err != nil {
+	if _, err := CheckAllOnce(context.Background(), *slogger, conf); err != nil {
 		t.Errorf("Test failed: %v", err)
 	}
 	end_time := time.Now().Unix()
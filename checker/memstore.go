@@ -0,0 +1,555 @@
+package checker
+
+/***
+* This file implements ResultStore which keeps test results in memory.
+* Results can be snapshotted periodically into JSONL file (a `DbResult` per line, or `{"aggregate": DbAggregate}`),
+* so that badge server can read results of checker running without DB.
+* Snapshot appends only new results to the file, and the file is rewritten entirely only after results are pruned.
+* Rewritten file starts with `{"generation": N}`, so that readers parse only lines appended since their last read
+* unless N is changed.
+***/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Interval to write snapshot of MemoryStore into its file.
+const snapshotInterval = 10 * time.Second
+
+/***
+* ResultStore in memory.
+* @results: test results of each challenge, oldest first
+* @last_id: ID of the last result, which is assigned incrementally as SQL stores do
+* @aggs: aggregates of pruned results
+* @path: JSONL file of snapshot (not snapshotted if empty)
+* @unsaved: results not appended to snapshot yet
+* @rewrite: whether snapshot must be rewritten entirely, because results are pruned
+* @file: snapshot file when it's read or written last
+* @generation: generation of snapshot file
+* @offset: bytes of snapshot file which are read or written
+***/
+type MemoryStore struct {
+	mu         sync.Mutex
+	results    map[int][]DbResult
+	last_id    int64
+	aggs       map[aggregateKey]*DbAggregate
+	path       string
+	unsaved    []DbResult
+	rewrite    bool
+	file       os.FileInfo
+	generation int64
+	offset     int64
+	stop       chan struct{}
+	stopped    chan struct{}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{results: make(map[int][]DbResult), aggs: make(map[aggregateKey]*DbAggregate)}
+}
+
+/***
+* A line of snapshot file, which is either a result, an aggregate or the header of generation.
+***/
+type snapshotLine struct {
+	DbResult
+	Aggregate  *DbAggregate `json:"aggregate,omitempty"`
+	Generation int64        `json:"generation,omitempty"`
+}
+
+/***
+* Open MemoryStore snapshotted into `path`.
+* Existing results in the file are loaded.
+* If `interval` is positive, snapshot is written periodically and on Close.
+* Stores which never record results (e.g. of badge server) reload the file when it's updated.
+***/
+func NewFileStore(path string, interval time.Duration) (*MemoryStore, error) {
+	store := NewMemoryStore()
+	store.path = path
+	if err := store.load(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if interval > 0 {
+		store.stop = make(chan struct{})
+		store.stopped = make(chan struct{})
+		go func() {
+			defer close(store.stopped)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-store.stop:
+					return
+				case <-ticker.C:
+					store.Snapshot()
+				}
+			}
+		}()
+	}
+	return store, nil
+}
+
+/***
+* Lines of snapshot file.
+* @generation: generation in the header of the file (0 for file written before generations are introduced)
+* @end: offset after the last complete line
+***/
+type snapshotChunk struct {
+	lines      []snapshotLine
+	info       os.FileInfo
+	generation int64
+	end        int64
+}
+
+/***
+* Read complete lines of snapshot file after `offset`.
+* A line being appended by another process is left for the next read.
+***/
+func (s *MemoryStore) readSnapshot(offset int64) (snapshotChunk, error) {
+	chunk := snapshotChunk{end: offset}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return chunk, err
+	}
+	defer f.Close()
+	if chunk.info, err = f.Stat(); err != nil {
+		return chunk, err
+	}
+
+	parse := func(line []byte) (snapshotLine, bool, error) {
+		var parsed snapshotLine
+		if len(bytes.TrimSpace(line)) == 0 {
+			return parsed, false, nil
+		}
+		err := json.Unmarshal(line, &parsed)
+		return parsed, err == nil, err
+	}
+	reader := bufio.NewReader(f)
+	header, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return chunk, err
+	}
+	if err == nil {
+		if parsed, ok, _ := parse(header); ok {
+			chunk.generation = parsed.Generation
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return chunk, err
+	}
+	reader.Reset(f)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return chunk, err
+		}
+		chunk.end += int64(len(line))
+		parsed, ok, err := parse(line)
+		if err != nil {
+			return chunk, err
+		}
+		if ok && parsed.Generation == 0 {
+			chunk.lines = append(chunk.lines, parsed)
+		}
+	}
+	return chunk, nil
+}
+
+/***
+* Merge lines of snapshot into memory. Results of each challenge are kept oldest first.
+***/
+func (s *MemoryStore) merge(lines []snapshotLine) {
+	unsorted := make(map[int]bool)
+	for _, line := range lines {
+		if line.Aggregate != nil {
+			s.aggs[line.Aggregate.key()] = line.Aggregate
+			continue
+		}
+		result := line.DbResult
+		// snapshots written before IDs are introduced have no ID
+		if result.Id == 0 {
+			result.Id = s.last_id + 1
+		}
+		if result.Id > s.last_id {
+			s.last_id = result.Id
+		}
+		chall_results := s.results[result.ChallId]
+		if len(chall_results) != 0 && result.Timestamp.Before(chall_results[len(chall_results)-1].Timestamp) {
+			unsorted[result.ChallId] = true
+		}
+		s.results[result.ChallId] = append(chall_results, result)
+	}
+	for challid := range unsorted {
+		chall_results := s.results[challid]
+		sort.SliceStable(chall_results, func(i, j int) bool {
+			return chall_results[i].Timestamp.Before(chall_results[j].Timestamp)
+		})
+	}
+}
+
+/***
+* Read snapshot file and replace results in memory.
+***/
+func (s *MemoryStore) load() error {
+	chunk, err := s.readSnapshot(0)
+	if err != nil {
+		return err
+	}
+	s.results = make(map[int][]DbResult)
+	s.aggs = make(map[aggregateKey]*DbAggregate)
+	s.last_id = 0
+	s.merge(chunk.lines)
+	s.file, s.generation, s.offset = chunk.info, chunk.generation, chunk.end
+	return nil
+}
+
+/***
+* Read lines appended to snapshot file since the last read, or the whole file if it's rewritten.
+***/
+func (s *MemoryStore) loadAppended() error {
+	chunk, err := s.readSnapshot(s.offset)
+	if err != nil || chunk.generation != s.generation {
+		return s.load()
+	}
+	s.merge(chunk.lines)
+	s.file, s.offset = chunk.info, chunk.end
+	return nil
+}
+
+/***
+* Reload snapshot file if it's updated by another process.
+* Appended lines are read incrementally, and the whole file is read again only when it's rewritten.
+***/
+func (s *MemoryStore) reloadIfUpdated() error {
+	if len(s.path) == 0 || len(s.unsaved) != 0 || s.rewrite {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if s.file != nil && os.SameFile(info, s.file) && info.Size() == s.offset && info.ModTime().Equal(s.file.ModTime()) {
+		return nil
+	}
+	if s.file != nil && info.Size() > s.offset {
+		return s.loadAppended()
+	}
+	return s.load()
+}
+
+/***
+* Write results not saved yet into snapshot file.
+* They're appended if the file is the one written last. Otherwise (e.g. after prune, or the file has
+* partial line of interrupted write), all results are rewritten.
+***/
+func (s *MemoryStore) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.path) == 0 || (!s.rewrite && len(s.unsaved) == 0) {
+		return nil
+	}
+	if !s.rewrite && s.file != nil {
+		if info, err := os.Stat(s.path); err == nil && os.SameFile(info, s.file) && info.Size() == s.offset {
+			return s.appendSnapshot()
+		}
+	}
+	return s.rewriteSnapshot()
+}
+
+/***
+* Append unsaved results to snapshot file in a single write.
+***/
+func (s *MemoryStore) appendSnapshot() error {
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, result := range s.unsaved {
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(lines.Bytes())
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		// the file may have partial line, so it's rewritten next time
+		s.file = nil
+		return err
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.file = info
+	}
+	s.offset += int64(lines.Len())
+	s.unsaved = nil
+	return nil
+}
+
+/***
+* Write all results and aggregates into snapshot file.
+* The file is replaced atomically, so readers never see partial snapshot.
+***/
+func (s *MemoryStore) rewriteSnapshot() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	generation := time.Now().UnixNano()
+	if err := encoder.Encode(snapshotLine{Generation: generation}); err != nil {
+		tmp.Close()
+		return err
+	}
+	challids := make([]int, 0, len(s.results))
+	for challid := range s.results {
+		challids = append(challids, challid)
+	}
+	sort.Ints(challids)
+	for _, challid := range challids {
+		for _, result := range s.results[challid] {
+			if err := encoder.Encode(result); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	for _, agg := range s.sortedAggregates() {
+		if err := encoder.Encode(snapshotLine{Aggregate: &agg}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		s.file = nil
+		return err
+	}
+	s.file, s.generation, s.offset = info, generation, info.Size()
+	s.unsaved = nil
+	s.rewrite = false
+	return nil
+}
+
+func (s *MemoryStore) RecordResult(chall Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := chall.intoDbResult()
+	result.Timestamp = time.Now()
+	s.appendResult(result)
+	return nil
+}
+
+/***
+* Append result with a new ID. Caller must hold the lock.
+***/
+func (s *MemoryStore) appendResult(result DbResult) {
+	s.last_id++
+	result.Id = s.last_id
+	s.results[result.ChallId] = append(s.results[result.ChallId], result)
+	if len(s.path) != 0 {
+		s.unsaved = append(s.unsaved, result)
+	}
+}
+
+func (s *MemoryStore) FetchResult(challid int, limit int) ([]DbResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadIfUpdated(); err != nil {
+		return nil, err
+	}
+
+	chall_results := s.results[challid]
+	results := make([]DbResult, 0)
+	for i := len(chall_results) - 1; i >= 0 && len(results) < limit; i-- {
+		results = append(results, chall_results[i])
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) FetchRun(runid string) ([]DbResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadIfUpdated(); err != nil {
+		return nil, err
+	}
+
+	results := make([]DbResult, 0)
+	for _, chall_results := range s.results {
+		for _, result := range chall_results {
+			if result.RunId == runid {
+				results = append(results, result)
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].ChallId != results[j].ChallId {
+			return results[i].ChallId < results[j].ChallId
+		}
+		return results[i].Timestamp.Before(results[j].Timestamp)
+	})
+	return results, nil
+}
+
+func (s *MemoryStore) FetchResultRange(challid int, since time.Time, until time.Time) ([]DbResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadIfUpdated(); err != nil {
+		return nil, err
+	}
+
+	results := make([]DbResult, 0)
+	for _, result := range s.results[challid] {
+		if result.Timestamp.Before(since) {
+			// keep only the last one before `since`
+			results = append(results[:0], result)
+		} else if result.Timestamp.Before(until) {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) FetchResultsSince(challid int, since time.Time, after_id int64, limit int) ([]DbResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadIfUpdated(); err != nil {
+		return nil, err
+	}
+
+	results := make([]DbResult, 0)
+	for _, result := range s.results[challid] {
+		if len(results) >= limit {
+			break
+		}
+		if result.Timestamp.After(since) || (result.Timestamp.Equal(since) && result.Id > after_id) {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) FetchLatestResults() ([]DbResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadIfUpdated(); err != nil {
+		return nil, err
+	}
+
+	results := make([]DbResult, 0, len(s.results))
+	for _, chall_results := range s.results {
+		if len(chall_results) != 0 {
+			results = append(results, chall_results[len(chall_results)-1])
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ChallId < results[j].ChallId
+	})
+	return results, nil
+}
+
+func (s *MemoryStore) sortedAggregates() []DbAggregate {
+	aggs := make([]DbAggregate, 0, len(s.aggs))
+	for _, agg := range s.aggs {
+		aggs = append(aggs, *agg)
+	}
+	sortAggregates(aggs)
+	return aggs
+}
+
+func (s *MemoryStore) Prune(cutoff time.Time, granularity string) (int, error) {
+	if _, ok := bucketSizes[granularity]; !ok {
+		return 0, fmt.Errorf("Unknown granularity of downsampling: %s", granularity)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pruned := make([]DbResult, 0)
+	for challid, chall_results := range s.results {
+		kept := make([]DbResult, 0, len(chall_results))
+		for _, result := range chall_results {
+			if result.Timestamp.Before(cutoff) {
+				pruned = append(pruned, result)
+			} else {
+				kept = append(kept, result)
+			}
+		}
+		s.results[challid] = kept
+	}
+	for _, agg := range aggregateResults(pruned, granularity) {
+		if existing, ok := s.aggs[agg.key()]; ok {
+			existing.merge(agg)
+		} else {
+			agg := agg
+			s.aggs[agg.key()] = &agg
+		}
+	}
+	if len(pruned) != 0 && len(s.path) != 0 {
+		s.rewrite = true
+	}
+	return len(pruned), nil
+}
+
+func (s *MemoryStore) FetchAggregates(challid int, since time.Time) ([]DbAggregate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadIfUpdated(); err != nil {
+		return nil, err
+	}
+
+	aggs := make([]DbAggregate, 0)
+	for _, agg := range s.sortedAggregates() {
+		if agg.ChallId == challid && !agg.Bucket.Before(since) {
+			aggs = append(aggs, agg)
+		}
+	}
+	return aggs, nil
+}
+
+/***
+* Stop periodic snapshot and write the last one.
+***/
+func (s *MemoryStore) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.stopped
+		s.stop = nil
+	}
+	return s.Snapshot()
+}
@@ -0,0 +1,181 @@
+package checker
+
+/***
+* This file implements tests of in-memory result store and its snapshot.
+***/
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	for _, result := range []TestResult{TestFailure, TestTimeout, TestSuccess} {
+		store.RecordResult(Challenge{Name: "memory", Id: 1, Result: result})
+	}
+
+	results, _ := store.FetchResult(1, 2)
+	if len(results) != 2 || results[0].Result != TestSuccess || results[1].Result != TestTimeout {
+		t.Errorf("Results must be newest first: %v", results)
+	}
+	if results, _ := store.FetchResult(1, 10); len(results) != 3 {
+		t.Errorf("Unexpected # of results: %v", results)
+	}
+	if results, _ := store.FetchResult(2, 10); len(results) != 0 {
+		t.Errorf("Challenge without results must have no result: %v", results)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Failed to close memory store: %v", err)
+	}
+}
+
+func TestFileStoreSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	writer, err := NewFileStore(path, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	reader, err := OpenStore("jsonfile", path)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	defer reader.Close()
+
+	// reader sees results after periodic snapshot
+	writer.RecordResult(Challenge{Name: "file", Id: 1, Result: TestFailure})
+	time.Sleep(100 * time.Millisecond)
+	if results, err := reader.FetchResult(1, 10); err != nil || len(results) != 1 || results[0].Result != TestFailure {
+		t.Errorf("Reader must see snapshotted results: %v, %v", results, err)
+	}
+
+	// last results are written on close
+	writer.RecordResult(Challenge{Name: "file", Id: 1, Result: TestSuccess})
+	writer.Close()
+	results, err := reader.FetchResult(1, 10)
+	if err != nil || len(results) != 2 || results[0].Result != TestSuccess || results[0].Name != "file" {
+		t.Errorf("Reader must reload updated snapshot: %v, %v", results, err)
+	}
+
+	// reopened store keeps results
+	reopened, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen file store: %v", err)
+	}
+	defer reopened.Close()
+	if results, _ := reopened.FetchResult(1, 10); len(results) != 2 || !results[0].Timestamp.After(results[1].Timestamp) {
+		t.Errorf("Results must be loaded from snapshot: %v", results)
+	}
+}
+
+func TestFileStoreAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	writer, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	reader, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	countLines := func() int {
+		data, _ := ioutil.ReadFile(path)
+		return strings.Count(string(data), "\n")
+	}
+
+	writer.RecordResult(Challenge{Name: "file", Id: 1, Result: TestFailure})
+	writer.Snapshot()
+	first, _ := os.Stat(path)
+	reader.FetchResult(1, 10)
+
+	// new results are appended to the same file
+	writer.RecordResult(Challenge{Name: "file", Id: 1, Result: TestSuccess})
+	writer.RecordResult(Challenge{Name: "file", Id: 2, Result: TestSuccess})
+	writer.Snapshot()
+	if info, _ := os.Stat(path); !os.SameFile(first, info) || countLines() != 4 {
+		t.Errorf("Results must be appended to snapshot: %d lines", countLines())
+	}
+	// reader reads only appended lines
+	reader.results[1][0].Name = "read before"
+	if results, err := reader.FetchResult(1, 10); err != nil || len(results) != 2 || results[1].Name != "read before" || results[0].Result != TestSuccess {
+		t.Errorf("Reader must read appended lines: %v, %v", results, err)
+	}
+
+	// line being appended is read after it's completed
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"id":4,"challid":2,"name":"file","timestamp":"2100-01-01T00:00:00Z",`)
+	if results, err := reader.FetchResult(2, 10); err != nil || len(results) != 1 {
+		t.Errorf("Partial line must be left: %v, %v", results, err)
+	}
+	f.WriteString(`"result":1}` + "\n")
+	f.Close()
+	if results, err := reader.FetchResult(2, 10); err != nil || len(results) != 2 || results[0].Id != 4 {
+		t.Errorf("Completed line must be read: %v, %v", results, err)
+	}
+
+	// snapshot changed by others is rewritten
+	writer.RecordResult(Challenge{Name: "file", Id: 3, Result: TestSuccess})
+	writer.Snapshot()
+	if reader.generation == writer.generation || countLines() != 5 {
+		t.Errorf("Changed snapshot must be rewritten: %d lines", countLines())
+	}
+
+	// pruned results are removed by rewriting the file
+	writer.RecordResult(Challenge{Name: "file", Id: 3, Result: TestFailure})
+	writer.Snapshot()
+	generation := writer.generation
+	if n, err := writer.Prune(time.Now().Add(time.Hour), "hourly"); err != nil || n != 5 {
+		t.Fatalf("Failed to prune: %d, %v", n, err)
+	}
+	writer.Snapshot()
+	if writer.generation == generation || countLines() != 6 {
+		t.Errorf("Pruned snapshot must be rewritten with aggregates: %d lines", countLines())
+	}
+	if results, err := reader.FetchResult(1, 10); err != nil || len(results) != 0 {
+		t.Errorf("Reader must reload rewritten snapshot: %v, %v", results, err)
+	}
+	if aggs, err := reader.FetchAggregates(1, time.Time{}); err != nil || len(aggs) != 2 {
+		t.Errorf("Reader must load aggregates: %v, %v", aggs, err)
+	}
+}
+
+func TestCheckerNodb(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challs_dir := createFakeChallsDir(t, 3)
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+
+	conf := CheckerConfig{Infofile: "info.json", ChallsDir: challs_dir, Nodb: true, Snapshot: path}
+	checker := Checker{logger: *slogger, conf: conf, runner: newFakeRunner(0, 1, 0)}
+	if _, err := checker.CheckAllOnce(context.Background()); err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	if results, _ := checker.store.FetchResult(0, 10); len(results) != 1 {
+		t.Errorf("Results must be kept in memory: %v", results)
+	}
+	checker.Close()
+
+	store, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	defer store.Close()
+	counts := make(map[TestResult]int)
+	for i := 0; i < 3; i++ {
+		results, _ := store.FetchResult(i, 10)
+		if len(results) != 1 {
+			t.Fatalf("Unexpected results of challenge %d: %v", i, results)
+		}
+		counts[results[0].Result]++
+	}
+	if counts[TestSuccess] != 2 || counts[TestFailure] != 1 {
+		t.Errorf("Unexpected results: %v", counts)
+	}
+}
@@ -0,0 +1,283 @@
+package checker
+
+/***
+* This file implements versioned schema migrations of SQL stores.
+* Applied versions are tracked in `schema_version` table, and migrations newer than them are applied in order.
+* Each migration has statements for every dialect, because DDL differs among them.
+* Migrations must be only appended, and never modified after released.
+***/
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/***
+* A version of schema.
+* @statements: DDL statements of each dialect
+***/
+type migration struct {
+	version     int
+	description string
+	statements  map[string][]string
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create test_result table",
+		statements: map[string][]string{
+			// same as setup.test.sql, so that existing tables are kept as they are
+			"mysql": {
+				"create table if not exists `test_result` (`challid` int not null, `name` varchar(255) not null, `result` int not null, `timestamp` datetime not null)",
+			},
+			"postgres": {
+				"create table if not exists test_result (challid integer not null, name varchar(255) not null, result integer not null, timestamp timestamptz not null)",
+			},
+			"sqlite": {
+				"create table if not exists test_result (challid integer not null, name text not null, result integer not null, timestamp datetime not null)",
+			},
+		},
+	},
+	{
+		version:     2,
+		description: "add primary key and index of (challid, timestamp) to test_result",
+		statements: map[string][]string{
+			"mysql": {
+				"alter table `test_result` add column `id` bigint not null auto_increment primary key first",
+				"create index `test_result_challid_timestamp` on `test_result` (`challid`, `timestamp`)",
+			},
+			"postgres": {
+				"alter table test_result add column id bigserial primary key",
+				"create index test_result_challid_timestamp on test_result (challid, timestamp)",
+			},
+			// SQLite can't add primary key to existing table, so the table is re-created
+			"sqlite": {
+				"create table test_result_v2 (id integer primary key autoincrement, challid integer not null, name text not null, result integer not null, timestamp datetime not null)",
+				"insert into test_result_v2 (challid, name, result, timestamp) select challid, name, result, timestamp from test_result order by timestamp",
+				"drop table test_result",
+				"alter table test_result_v2 rename to test_result",
+				"create index test_result_challid_timestamp on test_result (challid, timestamp)",
+			},
+		},
+	},
+	{
+		version:     3,
+		description: "add run ID, attempts, durations, exit code, hostname and error to test_result",
+		statements: map[string][]string{
+			"mysql": {
+				"alter table `test_result` add column `runid` varchar(64) not null default '', add column `attempt` int not null default 0, add column `max_attempts` int not null default 0, add column `build_ms` bigint not null default 0, add column `run_ms` bigint not null default 0, add column `exit_code` int not null default -1, add column `hostname` varchar(255) not null default '', add column `error` varchar(255) not null default ''",
+				"create index `test_result_runid` on `test_result` (`runid`)",
+			},
+			"postgres": {
+				"alter table test_result add column runid varchar(64) not null default '', add column attempt integer not null default 0, add column max_attempts integer not null default 0, add column build_ms bigint not null default 0, add column run_ms bigint not null default 0, add column exit_code integer not null default -1, add column hostname varchar(255) not null default '', add column error varchar(255) not null default ''",
+				"create index test_result_runid on test_result (runid)",
+			},
+			"sqlite": {
+				"alter table test_result add column runid text not null default ''",
+				"alter table test_result add column attempt integer not null default 0",
+				"alter table test_result add column max_attempts integer not null default 0",
+				"alter table test_result add column build_ms integer not null default 0",
+				"alter table test_result add column run_ms integer not null default 0",
+				"alter table test_result add column exit_code integer not null default -1",
+				"alter table test_result add column hostname text not null default ''",
+				"alter table test_result add column error text not null default ''",
+				"create index test_result_runid on test_result (runid)",
+			},
+		},
+	},
+	{
+		version:     4,
+		description: "create test_result_agg table of downsampled results",
+		statements: map[string][]string{
+			"mysql": {
+				"create table if not exists `test_result_agg` (`challid` int not null, `name` varchar(255) not null, `bucket` datetime not null, `granularity` varchar(16) not null, `result` int not null, `num` bigint not null, `min_ms` bigint not null, `max_ms` bigint not null, `sum_ms` bigint not null, primary key (`challid`, `granularity`, `bucket`, `result`))",
+			},
+			"postgres": {
+				"create table if not exists test_result_agg (challid integer not null, name varchar(255) not null, bucket timestamptz not null, granularity varchar(16) not null, result integer not null, num bigint not null, min_ms bigint not null, max_ms bigint not null, sum_ms bigint not null, primary key (challid, granularity, bucket, result))",
+			},
+			"sqlite": {
+				"create table if not exists test_result_agg (challid integer not null, name text not null, bucket datetime not null, granularity text not null, result integer not null, num integer not null, min_ms integer not null, max_ms integer not null, sum_ms integer not null, primary key (challid, granularity, bucket, result))",
+			},
+		},
+	},
+	{
+		version:     5,
+		description: "add category to test_result",
+		statements: map[string][]string{
+			"mysql": {
+				"alter table `test_result` add column `category` varchar(255) not null default ''",
+			},
+			"postgres": {
+				"alter table test_result add column category varchar(255) not null default ''",
+			},
+			"sqlite": {
+				"alter table test_result add column category text not null default ''",
+			},
+		},
+	},
+}
+
+// Latest version of schema.
+var SchemaVersion = migrations[len(migrations)-1].version
+
+var schemaVersionTables = map[string]string{
+	"mysql":    "create table if not exists `schema_version` (`version` int not null primary key, `description` varchar(255) not null, `applied_at` datetime not null)",
+	"postgres": "create table if not exists schema_version (version integer not null primary key, description varchar(255) not null, applied_at timestamptz not null)",
+	"sqlite":   "create table if not exists schema_version (version integer not null primary key, description text not null, applied_at datetime not null)",
+}
+
+// Max time to wait for another process migrating the same database.
+const migrationLockTimeout = 10 * time.Minute
+
+// Key of PostgreSQL advisory lock held while migrating, which is `skbc` in ASCII.
+const postgresMigrationLockKey = 0x736b6263
+
+/***
+* Executor of statements, which is either a connection or a transaction.
+***/
+type migrationExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Rebind(query string) string
+}
+
+/***
+* Get current version of schema. 0 means no migration is applied.
+***/
+func currentSchemaVersion(ctx context.Context, conn *sqlx.Conn) (int, error) {
+	var version int
+	err := conn.GetContext(ctx, &version, "select coalesce(max(version), 0) from schema_version")
+	return version, err
+}
+
+/***
+* Take lock of migrations on the connection, so that processes opening the same database (e.g. checker and badge server) migrate one by one.
+*		- mysql: named lock of the database, because DDL commits implicitly and transaction can't serialize it
+*		- postgres: advisory lock
+*		- sqlite: write transaction, in which whole migrations run
+* Returns function to release the lock, which commits the transaction of SQLite if `ok`, or rolls it back.
+***/
+func lockMigrations(ctx context.Context, conn *sqlx.Conn, dialect string) (func(ok bool) error, error) {
+	switch dialect {
+	case "mysql":
+		var locked sql.NullInt64
+		if err := conn.GetContext(ctx, &locked, "select get_lock(concat('skbctf-status:', database()), ?)", int(migrationLockTimeout.Seconds())); err != nil {
+			return nil, err
+		}
+		if !locked.Valid || locked.Int64 != 1 {
+			return nil, fmt.Errorf("Timed out waiting for another process migrating the database.")
+		}
+		return func(bool) error {
+			_, err := conn.ExecContext(context.Background(), "do release_lock(concat('skbctf-status:', database()))")
+			return err
+		}, nil
+	case "postgres":
+		lock_ctx, cancel := context.WithTimeout(ctx, migrationLockTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(lock_ctx, "select pg_advisory_lock($1)", postgresMigrationLockKey); err != nil {
+			return nil, err
+		}
+		return func(bool) error {
+			_, err := conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", postgresMigrationLockKey)
+			return err
+		}, nil
+	case "sqlite":
+		// waits for other writers up to busy_timeout
+		if _, err := conn.ExecContext(ctx, "begin immediate"); err != nil {
+			return nil, err
+		}
+		return func(ok bool) error {
+			if !ok {
+				_, err := conn.ExecContext(context.Background(), "rollback")
+				return err
+			}
+			_, err := conn.ExecContext(context.Background(), "commit")
+			return err
+		}, nil
+	default:
+		return nil, fmt.Errorf("Migrations are not supported for dialect: %s", dialect)
+	}
+}
+
+/***
+* Apply migrations newer than current version.
+* Migrations are serialized among processes by lock, and current version is read after the lock is taken.
+* Returns versions before and after migrations.
+***/
+func Migrate(db *sqlx.DB, dialect string) (from int, current int, err error) {
+	version_table, ok := schemaVersionTables[dialect]
+	if !ok {
+		return 0, 0, fmt.Errorf("Migrations are not supported for dialect: %s", dialect)
+	}
+
+	// locks are held by a session, so migrations run on a dedicated connection
+	ctx := context.Background()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	unlock, err := lockMigrations(ctx, conn, dialect)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to lock migrations: %v", err)
+	}
+	defer func() {
+		if unlock_err := unlock(err == nil); unlock_err != nil && err == nil {
+			err = unlock_err
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, version_table); err != nil {
+		return 0, 0, err
+	}
+	from, err = currentSchemaVersion(ctx, conn)
+	if err != nil {
+		return 0, 0, err
+	}
+	current = from
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, conn, dialect, m); err != nil {
+			return from, current, fmt.Errorf("Failed to migrate to version %d (%s): %v", m.version, m.description, err)
+		}
+		current = m.version
+	}
+	return from, current, nil
+}
+
+/***
+* Apply a migration and record its version in a transaction.
+* SQLite is already in the transaction of the lock, so statements are executed on the connection.
+* Note that MySQL commits DDL implicitly, so failed migration of MySQL may need manual recovery.
+***/
+func applyMigration(ctx context.Context, conn *sqlx.Conn, dialect string, m migration) error {
+	if dialect == "sqlite" {
+		return execMigration(ctx, conn, dialect, m)
+	}
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := execMigration(ctx, tx, dialect, m); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func execMigration(ctx context.Context, execer migrationExecer, dialect string, m migration) error {
+	for _, statement := range m.statements[dialect] {
+		if _, err := execer.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	query := execer.Rebind("insert into schema_version (version, description, applied_at) values (?, ?, ?)")
+	_, err := execer.ExecContext(ctx, query, m.version, m.description, time.Now().UTC().Round(0))
+	return err
+}
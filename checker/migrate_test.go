@@ -0,0 +1,123 @@
+package checker
+
+/***
+* This file implements tests of schema migrations using SQLite.
+***/
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestMigrateLegacySqlite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sqlx.Connect("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+
+	// table created by hand before migrations are introduced
+	db.MustExec("create table test_result (challid integer not null, name text not null, result integer not null, timestamp datetime not null)")
+	for i, result := range []TestResult{TestFailure, TestSuccess} {
+		db.MustExec("insert into test_result (challid, name, result, timestamp) values (?, ?, ?, ?)", 7, "legacy", result, time.Now().Add(time.Duration(i)*time.Second))
+	}
+	db.Close()
+
+	store, err := OpenStore("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open legacy SQLite store: %v", err)
+	}
+	if from, to := store.(VersionedStore).SchemaVersions(); from != 0 || to != SchemaVersion {
+		t.Errorf("Unexpected schema versions: %d -> %d", from, to)
+	}
+
+	// existing results are kept
+	results, err := store.FetchResult(7, 10)
+	if err != nil || len(results) != 2 || results[0].Result != TestSuccess {
+		t.Errorf("Results must be kept after migration: %v, %v", results, err)
+	}
+	store.RecordResult(Challenge{Name: "legacy", Id: 7, Result: TestTimeout})
+
+	sql_store := store.(*sqlStore)
+	var ids []int
+	if err := sql_store.db.Select(&ids, "select id from test_result order by id"); err != nil || len(ids) != 3 || ids[0] != 1 || ids[2] != 3 {
+		t.Errorf("Rows must have sequential IDs: %v, %v", ids, err)
+	}
+	var index_num int
+	sql_store.db.Get(&index_num, "select count(*) from sqlite_master where type = 'index' and name = 'test_result_challid_timestamp'")
+	if index_num != 1 {
+		t.Error("Index of (challid, timestamp) must be created.")
+	}
+	store.Close()
+
+	// migrations are applied only once
+	store, err = OpenStore("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to reopen SQLite store: %v", err)
+	}
+	defer store.Close()
+	if from, to := store.(VersionedStore).SchemaVersions(); from != SchemaVersion || to != SchemaVersion {
+		t.Errorf("Unexpected schema versions: %d -> %d", from, to)
+	}
+	var applied int
+	store.(*sqlStore).db.Get(&applied, "select count(*) from schema_version")
+	if applied != len(migrations) {
+		t.Errorf("Unexpected # of applied migrations: %d", applied)
+	}
+}
+
+func TestMigrateConcurrentSqlite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "concurrent.db")
+
+	// checker and badge server migrate the same database at startup
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			store, err := OpenStore("sqlite", path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			store.Close()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent migrations must not fail: %v", err)
+	}
+
+	store, err := OpenStore("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to reopen SQLite store: %v", err)
+	}
+	defer store.Close()
+	var applied int
+	store.(*sqlStore).db.Get(&applied, "select count(*) from schema_version")
+	if applied != len(migrations) {
+		t.Errorf("Each migration must be applied once: %d", applied)
+	}
+}
+
+func TestMigrationsComplete(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Versions of migrations must be sequential: %d", m.version)
+		}
+		for dialect := range schemaVersionTables {
+			if len(m.statements[dialect]) == 0 {
+				t.Errorf("Migration %d has no statement for %s.", m.version, dialect)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package checker
+
+/***
+* This file implements worker pool to execute tests.
+* Pool has fixed number of workers, and each worker executes tests one by one.
+***/
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/***
+* Summary of a run.
+* @RunId: ID of the run
+* @Counts: # of challenges for each result
+* @Durations: time taken to check each challenge, keyed by challenge ID
+* @Elapsed: time taken for whole run
+***/
+type Summary struct {
+	RunId     string
+	Counts    map[TestResult]int
+	Durations map[int]time.Duration
+	Elapsed   time.Duration
+}
+
+func newSummary(run_id string) Summary {
+	return Summary{
+		RunId:     run_id,
+		Counts:    make(map[TestResult]int),
+		Durations: make(map[int]time.Duration),
+	}
+}
+
+func (s *Summary) add(chall Challenge, elapsed time.Duration) {
+	s.Counts[chall.Result]++
+	s.Durations[chall.Id] = elapsed
+}
+
+/***
+* Total # of checked challenges.
+***/
+func (s Summary) Total() int {
+	total := 0
+	for _, count := range s.Counts {
+		total += count
+	}
+	return total
+}
+
+func (s Summary) String() string {
+	results := make([]string, 0, len(s.Counts))
+	for result, count := range s.Counts {
+		results = append(results, fmt.Sprintf("%v=%d", result, count))
+	}
+	sort.Strings(results)
+	return fmt.Sprintf("run %s finished %d tests in %v: %s", s.RunId, s.Total(), s.Elapsed, strings.Join(results, ", "))
+}
+
+/***
+* Execute tests of all executers by `workers` workers, and pass results to `handle` in order of completion.
+* `handle` is called from the caller goroutine, so it doesn't need to be goroutine-safe.
+* Once ctx is cancelled, tests not started yet are skipped, and running tests are aborted.
+* It returns after all started tests finish, so no goroutine is left.
+***/
+func runPool(ctx context.Context, executers []*Executer, workers uint, infofile string, timeout float64, handle func(Challenge, time.Duration)) {
+	type pool_result struct {
+		chall   Challenge
+		elapsed time.Duration
+	}
+	jobs := make(chan *Executer)
+	results := make(chan pool_result)
+
+	// start workers
+	var wg sync.WaitGroup
+	for i := uint(0); i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for executer := range jobs {
+				res := make(chan Challenge, 1)
+				start_time := time.Now()
+				executer.CheckWithTimeout(ctx, res, infofile, timeout)
+				results <- pool_result{chall: <-res, elapsed: time.Since(start_time)}
+			}
+		}()
+	}
+
+	// feed tests until all tests are fed or ctx is cancelled
+	go func() {
+		defer close(jobs)
+		for _, executer := range executers {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case jobs <- executer:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// close results after all workers finish
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		handle(result.chall, result.elapsed)
+	}
+}
@@ -0,0 +1,117 @@
+package checker
+
+/***
+* This file implements tests of worker pool using fake runner.
+***/
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/***
+* Create challenges directory with `num` challenges.
+***/
+func createFakeChallsDir(t *testing.T, num int) string {
+	t.Helper()
+	challs_dir := t.TempDir()
+	for i := 0; i < num; i++ {
+		createFakeChall(t, filepath.Join(challs_dir, fmt.Sprintf("chall%d", i)), fmt.Sprintf(`{"name": "fake%d", "id": %d}`, i, i))
+	}
+	return challs_dir
+}
+
+func TestPoolCheckAllOnce(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challs_dir := createFakeChallsDir(t, 5)
+
+	for _, pnum := range []uint{0, 1, 2, 8} {
+		runner := newFakeRunner(0)
+		runner.delay = 50 * time.Millisecond
+		conf := CheckerConfig{Parallel: pnum != 0, ParallelNum: pnum, Infofile: "info.json", Nodb: true, ChallsDir: challs_dir}
+		checker := Checker{logger: *slogger, conf: conf, runner: runner}
+
+		summary, err := checker.CheckAllOnce(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to check: %v", err)
+		}
+		if summary.Total() != 5 || summary.Counts[TestSuccess] != 5 || len(summary.Durations) != 5 {
+			t.Errorf("Unexpected summary: %v", summary)
+		}
+
+		// # of running tests is bounded by pool size
+		expected_max := int(checker.numWorkers())
+		if expected_max > 5 {
+			expected_max = 5
+		}
+		if runner.max_running != expected_max {
+			t.Errorf("Max # of running tests must be %d: %d", expected_max, runner.max_running)
+		}
+	}
+}
+
+func TestPoolNoChallenge(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	conf := CheckerConfig{Parallel: true, ParallelNum: 3, Infofile: "info.json", Nodb: true, ChallsDir: t.TempDir()}
+	checker := Checker{logger: *slogger, conf: conf, runner: newFakeRunner(0)}
+
+	done := make(chan Summary)
+	go func() {
+		summary, _ := checker.CheckAllOnce(context.Background())
+		done <- summary
+	}()
+	select {
+	case summary := <-done:
+		if summary.Total() != 0 {
+			t.Errorf("Unexpected summary: %v", summary)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Check of empty challenges directory doesn't finish.")
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	runner := newFakeRunner(0)
+	conf := CheckerConfig{Parallel: true, ParallelNum: 2, Infofile: "info.json", Nodb: true, ChallsDir: createFakeChallsDir(t, 4)}
+	checker := Checker{logger: *slogger, conf: conf, runner: runner}
+
+	// no test starts once cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	summary, err := checker.CheckAllOnce(ctx)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	if summary.Total() != 0 || runner.numRuns() != 0 {
+		t.Errorf("Tests must not be started after cancel: %v", summary)
+	}
+}
+
+func TestPoolAbort(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	runner := newFakeRunner()
+	runner.hang = true
+	conf := CheckerConfig{Parallel: true, ParallelNum: 2, Infofile: "info.json", Nodb: true, ChallsDir: createFakeChallsDir(t, 4)}
+	checker := Checker{logger: *slogger, conf: conf, runner: runner}
+
+	// running tests are aborted, and the rest are skipped
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	summary, err := checker.CheckAllOnce(ctx)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	if summary.Total() != 2 || summary.Counts[TestAborted] != 2 {
+		t.Errorf("Running tests must be aborted: %v", summary)
+	}
+}
@@ -1,12 +1,16 @@
 package checker
 
 /***
-* This file implements helper functions of mysql database.
+* This file implements helper functions of SQL database.
+* Queries are written with `?` placeholders and rebound for the driver of `db`.
 ***/
 
 import (
 	"fmt"
+	"os"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -17,32 +21,92 @@ import (
 * Note that this is different from `Challenge` structure, which also contains test result.
 ***/
 type DbResult struct {
-	ChallId   int        `db:"challid"`
-	Name      string     `db:"name"`
-	Result    TestResult `db:"result"`
-	Timestamp time.Time  `db:"timestamp"`
+	Id          int64      `db:"id" json:"id"`
+	ChallId     int        `db:"challid" json:"challid"`
+	Name        string     `db:"name" json:"name"`
+	Result      TestResult `db:"result" json:"result"`
+	Timestamp   time.Time  `db:"timestamp" json:"timestamp"`
+	RunId       string     `db:"runid" json:"runid"`
+	Attempt     uint       `db:"attempt" json:"attempt"`
+	MaxAttempts uint       `db:"max_attempts" json:"max_attempts"`
+	BuildMs     int64      `db:"build_ms" json:"build_ms"`
+	RunMs       int64      `db:"run_ms" json:"run_ms"`
+	ExitCode    int        `db:"exit_code" json:"exit_code"`
+	Hostname    string     `db:"hostname" json:"hostname"`
+	Error       string     `db:"error" json:"error"`
+	Category    string     `db:"category" json:"category"`
 }
 
+// Columns of test result table, in the same order as `DbResult`.
+const resultColumns = "challid, name, result, timestamp, runid, attempt, max_attempts, build_ms, run_ms, exit_code, hostname, error, category"
+
+// Columns selected from test result table. `id` is assigned by DB, so it's not in `resultColumns`.
+const selectColumns = "id, " + resultColumns
+
+// Named parameters of `resultColumns`.
+const resultValues = ":challid, :name, :result, :timestamp, :runid, :attempt, :max_attempts, :build_ms, :run_ms, :exit_code, :hostname, :error, :category"
+
+// Max length of error message recorded with result.
+const maxErrorLength = 255
+
+var hostname, _ = os.Hostname()
+
 /***
 * Converter from `Challenge` structure into `DBResult`.
 ***/
 func (chall *Challenge) intoDbResult() DbResult {
 	return DbResult{
-		ChallId: chall.Id,
-		Name:    chall.Name,
-		Result:  chall.Result,
+		ChallId:     chall.Id,
+		Name:        chall.Name,
+		Result:      chall.Result,
+		RunId:       chall.RunId,
+		Attempt:     chall.Attempts,
+		MaxAttempts: chall.MaxAttempts,
+		BuildMs:     chall.BuildTime.Milliseconds(),
+		RunMs:       chall.RunTime.Milliseconds(),
+		ExitCode:    chall.ExitCode,
+		Hostname:    hostname,
+		Error:       shortError(chall.Error),
+		Category:    chall.Category,
 	}
 }
 
 /***
-* Connect to mysql server and returns instance.
+* Shorten error message into its first line of at most `maxErrorLength` bytes.
 ***/
-func Connect(dbuser string, dbpass string, dbhost string, dbname string) (*sqlx.DB, error) {
+func shortError(msg string) string {
+	msg = strings.TrimSpace(msg)
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	if len(msg) <= maxErrorLength {
+		return msg
+	}
+	// don't cut in the middle of multi-byte character
+	cut := maxErrorLength
+	for cut > 0 && !utf8.RuneStart(msg[cut]) {
+		cut--
+	}
+	return msg[:cut]
+}
+
+func connectMysql(dbuser string, dbpass string, dbhost string, dbname string) (*sqlx.DB, error) {
 	dsn := fmt.Sprintf("%s:%s@(%s)/%s?parseTime=true&autocommit=0", dbuser, dbpass, dbhost, dbname)
-	db, err := sqlx.Connect("mysql", dsn)
+	return sqlx.Connect("mysql", dsn)
+}
+
+/***
+* Connect to mysql server, apply schema migrations and returns instance.
+***/
+func Connect(dbuser string, dbpass string, dbhost string, dbname string) (*sqlx.DB, error) {
+	db, err := connectMysql(dbuser, dbpass, dbhost, dbname)
 	if err != nil {
 		return nil, err
 	}
+	if _, _, err := Migrate(db, "mysql"); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -52,10 +116,12 @@ func Connect(dbuser string, dbpass string, dbhost string, dbname string) (*sqlx.
 func RecordResult(db *sqlx.DB, chall Challenge) error {
 	tx := db.MustBegin()
 	dbresult := chall.intoDbResult()
-	dbresult.Timestamp = time.Now()
-	query := "insert into test_result(challid, name, result, timestamp) values(:challid, :name, :result, :timestamp)"
+	// strip monotonic clock reading, which SQLite driver writes into timestamp
+	dbresult.Timestamp = time.Now().Round(0)
+	query := "insert into test_result(" + resultColumns + ") values(" + resultValues + ")"
 	_, err := tx.NamedExec(query, dbresult)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	if err := tx.Commit(); err != nil {
@@ -71,9 +137,78 @@ func RecordResult(db *sqlx.DB, chall Challenge) error {
 func FetchResult(db *sqlx.DB, challid int, limit int) ([]DbResult, error) {
 	var results []DbResult
 
-	query := `select challid, name, result, timestamp from test_result where challid = ? order by timestamp desc limit ?`
+	query := `select ` + selectColumns + ` from test_result where challid = ? order by timestamp desc, id desc limit ?`
+	tx := db.MustBegin()
+	if err := tx.Select(&results, tx.Rebind(query), challid, limit); err != nil {
+		tx.Rollback()
+		return results, err
+	}
+	if err := tx.Commit(); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+/***
+* Query test results of a run from DB, ordered by challenge ID.
+***/
+func FetchRun(db *sqlx.DB, runid string) ([]DbResult, error) {
+	var results []DbResult
+
+	query := `select ` + selectColumns + ` from test_result where runid = ? order by challid, timestamp, id`
+	tx := db.MustBegin()
+	if err := tx.Select(&results, tx.Rebind(query), runid); err != nil {
+		tx.Rollback()
+		return results, err
+	}
+	if err := tx.Commit(); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+/***
+* Query test results of the challenge in [since, until) from DB, oldest first.
+* The last result before `since` is also returned at the head if any, which tells the state at `since`.
+***/
+func FetchResultRange(db *sqlx.DB, challid int, since time.Time, until time.Time) ([]DbResult, error) {
+	var results []DbResult
+	// timestamps are recorded in local time
+	since = since.In(time.Local)
+	until = until.In(time.Local)
+
+	tx := db.MustBegin()
+	query := `select ` + selectColumns + ` from test_result where challid = ? and timestamp < ? order by timestamp desc, id desc limit 1`
+	if err := tx.Select(&results, tx.Rebind(query), challid, since); err != nil {
+		tx.Rollback()
+		return results, err
+	}
+	var in_range []DbResult
+	query = `select ` + selectColumns + ` from test_result where challid = ? and timestamp >= ? and timestamp < ? order by timestamp, id`
+	if err := tx.Select(&in_range, tx.Rebind(query), challid, since, until); err != nil {
+		tx.Rollback()
+		return results, err
+	}
+	if err := tx.Commit(); err != nil {
+		return results, err
+	}
+	return append(results, in_range...), nil
+}
+
+/***
+* Query at most `limit` test results of the challenge after cursor (`since`, `after_id`) from DB, ordered by timestamp and ID.
+* Results at `since` are returned only if their ID is greater than `after_id`, so 0 means all results at or after `since`.
+***/
+func FetchResultsSince(db *sqlx.DB, challid int, since time.Time, after_id int64, limit int) ([]DbResult, error) {
+	var results []DbResult
+	// timestamps are recorded in local time
+	since = since.In(time.Local)
+
+	// timestamps of MySQL are in seconds, so ID breaks ties of results in the same second
+	query := `select ` + selectColumns + ` from test_result where challid = ? and (timestamp > ? or (timestamp = ? and id > ?)) order by timestamp, id limit ?`
 	tx := db.MustBegin()
-	if err := tx.Select(&results, query, challid, limit); err != nil {
+	if err := tx.Select(&results, tx.Rebind(query), challid, since, since, after_id, limit); err != nil {
+		tx.Rollback()
 		return results, err
 	}
 	if err := tx.Commit(); err != nil {
@@ -81,3 +216,30 @@ func FetchResult(db *sqlx.DB, challid int, limit int) ([]DbResult, error) {
 	}
 	return results, nil
 }
+
+/***
+* Query the latest test result of each challenge from DB, ordered by challenge ID.
+***/
+func FetchLatestResults(db *sqlx.DB) ([]DbResult, error) {
+	var results []DbResult
+
+	// results recorded at the same time are ordered by ID, so that the last recorded one is kept
+	query := `select ` + selectColumns + ` from test_result t where timestamp = (select max(timestamp) from test_result where challid = t.challid) order by challid, id desc`
+	tx := db.MustBegin()
+	if err := tx.Select(&results, query); err != nil {
+		tx.Rollback()
+		return results, err
+	}
+	if err := tx.Commit(); err != nil {
+		return results, err
+	}
+
+	// drop duplicates recorded at the same time, except the one of the largest ID
+	latest := make([]DbResult, 0, len(results))
+	for _, result := range results {
+		if len(latest) == 0 || latest[len(latest)-1].ChallId != result.ChallId {
+			latest = append(latest, result)
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,242 @@
+package checker
+
+/***
+* This file implements retention of test results.
+* Raw results older than retention period are rolled into aggregate rows of hourly or daily buckets,
+* which hold counts and durations of each result, and then deleted.
+* Buckets are aligned to UTC, and cutoff is aligned to bucket boundary,
+* so that a bucket never has both raw and aggregated results.
+***/
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Interval of retention job in the checker.
+const pruneInterval = time.Hour
+
+/***
+* Aggregate of test results of a challenge in a bucket.
+* @Bucket: start time of the bucket
+* @Granularity: `hourly` or `daily`
+* @Count: # of results in the bucket
+* @MinMs, @MaxMs, @SumMs: run durations of solvers in milliseconds
+***/
+type DbAggregate struct {
+	ChallId     int        `db:"challid" json:"challid"`
+	Name        string     `db:"name" json:"name"`
+	Bucket      time.Time  `db:"bucket" json:"bucket"`
+	Granularity string     `db:"granularity" json:"granularity"`
+	Result      TestResult `db:"result" json:"result"`
+	Count       int64      `db:"num" json:"count"`
+	MinMs       int64      `db:"min_ms" json:"min_ms"`
+	MaxMs       int64      `db:"max_ms" json:"max_ms"`
+	SumMs       int64      `db:"sum_ms" json:"sum_ms"`
+}
+
+func (agg DbAggregate) AvgMs() float64 {
+	if agg.Count == 0 {
+		return 0
+	}
+	return float64(agg.SumMs) / float64(agg.Count)
+}
+
+var bucketSizes = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+}
+
+/***
+* Retention policy of test results.
+* @Days: days to keep raw results (kept forever if 0)
+* @Granularity: size of buckets raw results are rolled into
+***/
+type RetentionPolicy struct {
+	Days        float64 `json:"retention_days"`
+	Granularity string  `json:"downsample"`
+}
+
+func (p RetentionPolicy) validate() error {
+	if p.Days < 0 {
+		return fmt.Errorf("Retention days must not be negative: %v", p.Days)
+	}
+	if _, ok := bucketSizes[p.granularity()]; !ok {
+		return fmt.Errorf("Unknown granularity of downsampling: %s", p.Granularity)
+	}
+	return nil
+}
+
+func (p RetentionPolicy) granularity() string {
+	if len(p.Granularity) == 0 {
+		return "hourly"
+	}
+	return p.Granularity
+}
+
+/***
+* Time before which raw results are rolled up, aligned to bucket boundary.
+***/
+func (p RetentionPolicy) cutoff(now time.Time) time.Time {
+	keep := time.Duration(p.Days * float64(24*time.Hour))
+	return now.Add(-keep).UTC().Truncate(bucketSizes[p.granularity()])
+}
+
+/***
+* Key of aggregate row.
+***/
+type aggregateKey struct {
+	challid     int
+	granularity string
+	bucket      int64
+	result      TestResult
+}
+
+func (agg DbAggregate) key() aggregateKey {
+	return aggregateKey{challid: agg.ChallId, granularity: agg.Granularity, bucket: agg.Bucket.Unix(), result: agg.Result}
+}
+
+/***
+* Merge `other` aggregate of the same key into `agg`.
+***/
+func (agg *DbAggregate) merge(other DbAggregate) {
+	if agg.Count == 0 || other.MinMs < agg.MinMs {
+		agg.MinMs = other.MinMs
+	}
+	if other.MaxMs > agg.MaxMs {
+		agg.MaxMs = other.MaxMs
+	}
+	agg.Count += other.Count
+	agg.SumMs += other.SumMs
+	agg.Name = other.Name
+}
+
+/***
+* Aggregate raw results into buckets of the granularity, ordered by challenge, bucket and result.
+***/
+func aggregateResults(results []DbResult, granularity string) []DbAggregate {
+	size := bucketSizes[granularity]
+	aggs := make(map[aggregateKey]*DbAggregate)
+	for _, result := range results {
+		one := DbAggregate{
+			ChallId:     result.ChallId,
+			Name:        result.Name,
+			Bucket:      result.Timestamp.UTC().Truncate(size),
+			Granularity: granularity,
+			Result:      result.Result,
+			Count:       1,
+			MinMs:       result.RunMs,
+			MaxMs:       result.RunMs,
+			SumMs:       result.RunMs,
+		}
+		if agg, ok := aggs[one.key()]; ok {
+			agg.merge(one)
+		} else {
+			aggs[one.key()] = &one
+		}
+	}
+
+	sorted := make([]DbAggregate, 0, len(aggs))
+	for _, agg := range aggs {
+		sorted = append(sorted, *agg)
+	}
+	sortAggregates(sorted)
+	return sorted
+}
+
+func sortAggregates(aggs []DbAggregate) {
+	sort.Slice(aggs, func(i, j int) bool {
+		if aggs[i].ChallId != aggs[j].ChallId {
+			return aggs[i].ChallId < aggs[j].ChallId
+		}
+		if !aggs[i].Bucket.Equal(aggs[j].Bucket) {
+			return aggs[i].Bucket.Before(aggs[j].Bucket)
+		}
+		return aggs[i].Result < aggs[j].Result
+	})
+}
+
+const aggregateColumns = "challid, name, bucket, granularity, result, num, min_ms, max_ms, sum_ms"
+
+/***
+* Roll raw results before `cutoff` into aggregates and delete them in a transaction.
+* Returns # of deleted raw results.
+***/
+func PruneResults(db *sqlx.DB, cutoff time.Time, granularity string) (int, error) {
+	if _, ok := bucketSizes[granularity]; !ok {
+		return 0, fmt.Errorf("Unknown granularity of downsampling: %s", granularity)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	// raw results are recorded in local time
+	cutoff = cutoff.In(time.Local)
+	var results []DbResult
+	query := `select ` + resultColumns + ` from test_result where timestamp < ?`
+	if err := tx.Select(&results, tx.Rebind(query), cutoff); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if len(results) == 0 {
+		return 0, tx.Commit()
+	}
+
+	for _, agg := range aggregateResults(results, granularity) {
+		if err := upsertAggregate(tx, agg); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	res, err := tx.Exec(tx.Rebind(`delete from test_result where timestamp < ?`), cutoff)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	deleted, _ := res.RowsAffected()
+	return int(deleted), nil
+}
+
+/***
+* Merge aggregate into existing row of the same bucket, or insert it.
+* It's done in Go, because upsert syntax differs among dialects.
+***/
+func upsertAggregate(tx *sqlx.Tx, agg DbAggregate) error {
+	var existing []DbAggregate
+	query := `select ` + aggregateColumns + ` from test_result_agg where challid = ? and granularity = ? and bucket = ? and result = ?`
+	if err := tx.Select(&existing, tx.Rebind(query), agg.ChallId, agg.Granularity, agg.Bucket, agg.Result); err != nil {
+		return err
+	}
+
+	if len(existing) == 0 {
+		query = `insert into test_result_agg (` + aggregateColumns + `) values (:challid, :name, :bucket, :granularity, :result, :num, :min_ms, :max_ms, :sum_ms)`
+		_, err := tx.NamedExec(query, agg)
+		return err
+	}
+	merged := existing[0]
+	merged.merge(agg)
+	merged.Bucket = agg.Bucket
+	query = `update test_result_agg set name = :name, num = :num, min_ms = :min_ms, max_ms = :max_ms, sum_ms = :sum_ms
+		where challid = :challid and granularity = :granularity and bucket = :bucket and result = :result`
+	_, err := tx.NamedExec(query, merged)
+	return err
+}
+
+/***
+* Query aggregates of the challenge whose buckets start at or after `since`, oldest first.
+***/
+func FetchAggregates(db *sqlx.DB, challid int, since time.Time) ([]DbAggregate, error) {
+	var aggs []DbAggregate
+	query := `select ` + aggregateColumns + ` from test_result_agg where challid = ? and bucket >= ? order by bucket, result`
+	if err := db.Select(&aggs, db.Rebind(query), challid, since.UTC()); err != nil {
+		return aggs, err
+	}
+	return aggs, nil
+}
@@ -0,0 +1,140 @@
+package checker
+
+/***
+* This file implements tests of retention of test results.
+***/
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetentionCutoff(t *testing.T) {
+	now := time.Date(2021, 11, 10, 12, 34, 56, 0, time.UTC)
+	if cutoff := (RetentionPolicy{Days: 7}).cutoff(now); !cutoff.Equal(time.Date(2021, 11, 3, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Cutoff must be aligned to hour: %v", cutoff)
+	}
+	if cutoff := (RetentionPolicy{Days: 1.5, Granularity: "daily"}).cutoff(now); !cutoff.Equal(time.Date(2021, 11, 9, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Cutoff must be aligned to day: %v", cutoff)
+	}
+	if err := (RetentionPolicy{Days: 1, Granularity: "weekly"}).validate(); err == nil {
+		t.Error("Unknown granularity must be rejected.")
+	}
+}
+
+func TestAggregateResults(t *testing.T) {
+	base := time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)
+	results := []DbResult{
+		{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: base.Add(1 * time.Minute), RunMs: 100},
+		{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: base.Add(30 * time.Minute), RunMs: 300},
+		{ChallId: 1, Name: "a", Result: TestFailure, Timestamp: base.Add(40 * time.Minute), RunMs: 50},
+		{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: base.Add(70 * time.Minute), RunMs: 200},
+		{ChallId: 2, Name: "b", Result: TestSuccess, Timestamp: base.Add(10 * time.Minute), RunMs: 10},
+	}
+
+	aggs := aggregateResults(results, "hourly")
+	if len(aggs) != 4 {
+		t.Fatalf("Unexpected aggregates: %+v", aggs)
+	}
+	first := aggs[0]
+	if !first.Bucket.Equal(base) || first.Result != TestSuccess || first.Count != 2 || first.MinMs != 100 || first.MaxMs != 300 || first.AvgMs() != 200 {
+		t.Errorf("Unexpected aggregate: %+v", first)
+	}
+	if aggs[1].Result != TestFailure || !aggs[2].Bucket.Equal(base.Add(time.Hour)) || aggs[3].ChallId != 2 {
+		t.Errorf("Aggregates must be ordered by challenge, bucket and result: %+v", aggs)
+	}
+
+	if daily := aggregateResults(results, "daily"); len(daily) != 3 || daily[0].Count != 3 {
+		t.Errorf("Unexpected daily aggregates: %+v", daily)
+	}
+}
+
+/***
+* Put results with the given timestamps into the store.
+***/
+func putOldResults(t *testing.T, store ResultStore, results []DbResult) {
+	t.Helper()
+	switch store := store.(type) {
+	case *sqlStore:
+		for _, result := range results {
+			query := "insert into test_result(" + resultColumns + ") values(" + resultValues + ")"
+			if _, err := store.db.NamedExec(query, result); err != nil {
+				t.Fatalf("Failed to insert result: %v", err)
+			}
+		}
+	case *MemoryStore:
+		for _, result := range results {
+			store.appendResult(result)
+		}
+	}
+}
+
+func TestPruneStores(t *testing.T) {
+	sqlite, err := OpenStore("sqlite", filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	defer sqlite.Close()
+
+	now := time.Now()
+	cutoff := RetentionPolicy{Days: 1}.cutoff(now)
+	old := cutoff.Add(-3 * time.Hour).Truncate(time.Hour)
+	for name, store := range map[string]ResultStore{"sqlite": sqlite, "memory": NewMemoryStore()} {
+		putOldResults(t, store, []DbResult{
+			{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: old.Add(time.Minute).Local(), RunMs: 100},
+			{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: old.Add(2 * time.Minute).Local(), RunMs: 200},
+			{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: now.Add(-time.Minute).Local(), RunMs: 300},
+		})
+		if pruned, err := store.Prune(cutoff, "hourly"); err != nil || pruned != 2 {
+			t.Errorf("[%s] Old results must be pruned: %d, %v", name, pruned, err)
+		}
+		if results, _ := store.FetchResult(1, 10); len(results) != 1 || results[0].RunMs != 300 {
+			t.Errorf("[%s] Recent results must be kept: %+v", name, results)
+		}
+
+		// results rolled later are merged into the same bucket
+		putOldResults(t, store, []DbResult{
+			{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: old.Add(3 * time.Minute).Local(), RunMs: 50},
+		})
+		if pruned, err := store.Prune(cutoff, "hourly"); err != nil || pruned != 1 {
+			t.Errorf("[%s] Old results must be pruned: %d, %v", name, pruned, err)
+		}
+
+		aggs, err := store.FetchAggregates(1, old.Add(-time.Hour))
+		if err != nil || len(aggs) != 1 {
+			t.Fatalf("[%s] Unexpected aggregates: %+v, %v", name, aggs, err)
+		}
+		if agg := aggs[0]; !agg.Bucket.Equal(old) || agg.Count != 3 || agg.MinMs != 50 || agg.MaxMs != 200 || agg.SumMs != 350 || agg.Granularity != "hourly" {
+			t.Errorf("[%s] Unexpected aggregate: %+v", name, agg)
+		}
+		if aggs, _ := store.FetchAggregates(1, old.Add(time.Hour)); len(aggs) != 0 {
+			t.Errorf("[%s] Aggregates before `since` must be excluded: %+v", name, aggs)
+		}
+	}
+}
+
+func TestFileStoreAggregates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	store, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	putOldResults(t, store, []DbResult{{ChallId: 1, Name: "a", Result: TestFailure, Timestamp: old}})
+	store.RecordResult(Challenge{Name: "a", Id: 1, Result: TestSuccess})
+	store.Prune(RetentionPolicy{Days: 1}.cutoff(time.Now()), "hourly")
+	store.Close()
+
+	reopened, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen file store: %v", err)
+	}
+	defer reopened.Close()
+	if results, _ := reopened.FetchResult(1, 10); len(results) != 1 || results[0].Result != TestSuccess {
+		t.Errorf("Unexpected results in snapshot: %+v", results)
+	}
+	if aggs, _ := reopened.FetchAggregates(1, old.Add(-time.Hour)); len(aggs) != 1 || aggs[0].Result != TestFailure || aggs[0].Count != 1 {
+		t.Errorf("Aggregates must be snapshotted: %+v", aggs)
+	}
+}
@@ -0,0 +1,114 @@
+package checker
+
+/***
+* This file implements capturing and persisting of solver outputs.
+* Outputs of every try are written into a log directory keyed by challenge ID and run ID:
+*		<logdir>/<challid>/<runid>.log
+***/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Max size of stdout/stderr kept for each try.
+const MaxOutputSize = 64 * 1024
+
+/***
+* Writer which keeps only the last `max` bytes written.
+* Tail of outputs is kept because flags and errors usually appear at the end.
+***/
+type tailBuffer struct {
+	mu        sync.Mutex
+	max       int
+	buf       []byte
+	truncated int64
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.max; over > 0 {
+		b.truncated += int64(over)
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	return n, nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.truncated > 0 {
+		return fmt.Sprintf("[... %d bytes truncated ...]\n%s", b.truncated, b.buf)
+	}
+	return string(b.buf)
+}
+
+/***
+* Generate ID of a run, which is a set of tests executed at once.
+***/
+func NewRunId() string {
+	return fmt.Sprintf("%s-%04x", time.Now().Format("20060102-150405"), rand.Intn(0x10000))
+}
+
+var runIdPattern = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+func IsValidRunId(runid string) bool {
+	return runIdPattern.MatchString(runid)
+}
+
+func runLogPath(log_dir string, challid int, runid string) string {
+	return filepath.Join(log_dir, strconv.Itoa(challid), runid+".log")
+}
+
+/***
+* Append outputs of the last try of the challenge to log file of the run.
+***/
+func WriteRunLog(log_dir string, runid string, chall Challenge) error {
+	if !IsValidRunId(runid) {
+		return fmt.Errorf("Invalid run ID: %s", runid)
+	}
+	path := runLogPath(log_dir, chall.Id, runid)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	phase := fmt.Sprintf("try %d", chall.Attempts)
+	if chall.Attempts == 0 {
+		phase = "build"
+	}
+	_, err = fmt.Fprintf(f, "=== [%s] %s: %v (build %v, run %v) ===\n--- stdout ---\n%s\n--- stderr ---\n%s\n",
+		chall.Name, phase, chall.Result, chall.BuildTime, chall.RunTime, chall.Stdout, chall.Stderr)
+	return err
+}
+
+/***
+* Read log file of the run.
+***/
+func ReadRunLog(log_dir string, challid int, runid string) ([]byte, error) {
+	if !IsValidRunId(runid) {
+		return nil, fmt.Errorf("Invalid run ID: %s", runid)
+	}
+	return ioutil.ReadFile(runLogPath(log_dir, challid, runid))
+}
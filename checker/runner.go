@@ -0,0 +1,225 @@
+package checker
+
+/***
+* This file defines Runner interface, which is a backend to build and run solvers.
+* Executer only drives Runner, so it doesn't know how solvers are actually executed.
+* Also, it implements Runner which uses Docker CLI on the local host.
+***/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+/***
+* Backend to build and run solver of a challenge.
+* Implementations must be safe to be used from multiple goroutines.
+***/
+type Runner interface {
+	// Build solver image from `chall.Exploit_dir_name` and returns image reference.
+	// Build is aborted when ctx is cancelled.
+	Build(ctx context.Context, chall Challenge) (string, error)
+	// Run solver image as a container named `container` and blocks until it exits.
+	// Outputs of the solver are written to `stdout` and `stderr`.
+	// It returns exit code of the solver. Error is returned only when solver couldn't be run.
+	// Run returns when ctx is cancelled, but the container keeps running until it's killed by Kill.
+	Run(ctx context.Context, chall Challenge, image string, container string, stdout io.Writer, stderr io.Writer) (int, error)
+	// Forcibly stop running container.
+	// Kill and Cleanup are called after ctx of Run is cancelled, so they don't take ctx.
+	Kill(container string) error
+	// Remove resources of the container. It must be safe to call it for already removed container.
+	Cleanup(container string) error
+}
+
+/***
+* Error which means the backend of Runner (e.g. Docker daemon) is unavailable.
+* This is neither a fault of challenges nor solvers.
+***/
+type InfraError struct {
+	Err error
+}
+
+func (e *InfraError) Error() string {
+	return fmt.Sprintf("runner is unavailable: %v", e.Err)
+}
+
+func (e *InfraError) Unwrap() error {
+	return e.Err
+}
+
+func IsInfraError(err error) bool {
+	var infra_err *InfraError
+	return errors.As(err, &infra_err)
+}
+
+/***
+* Create Runner specified by config.
+* `cli` (default) uses Docker CLI, and `api` uses Docker Engine API.
+***/
+func NewRunner(conf CheckerConfig) (Runner, error) {
+	switch conf.Runner {
+	case "", "cli":
+		return NewDockerCliRunner(), nil
+	case "api":
+		socket := conf.DockerSock
+		if len(socket) == 0 && strings.HasPrefix(os.Getenv("DOCKER_HOST"), "unix://") {
+			socket = strings.TrimPrefix(os.Getenv("DOCKER_HOST"), "unix://")
+		}
+		return NewDockerApiRunner(socket), nil
+	default:
+		return nil, fmt.Errorf("Unknown runner: %s", conf.Runner)
+	}
+}
+
+/***
+* Runner which uses `docker` command on the local host.
+* @procs: running `docker run` processes keyed by container name
+***/
+type DockerCliRunner struct {
+	mu    sync.Mutex
+	procs map[string]*exec.Cmd
+}
+
+func NewDockerCliRunner() *DockerCliRunner {
+	return &DockerCliRunner{procs: make(map[string]*exec.Cmd)}
+}
+
+func (r *DockerCliRunner) Build(ctx context.Context, chall Challenge) (string, error) {
+	var outbuf, errbuf bytes.Buffer
+	image_name := fmt.Sprintf("solver_%d", chall.Id)
+	cmd := exec.CommandContext(ctx, "docker", "build", "-q", "-t", image_name, chall.Exploit_dir_name)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		if isCliInfraError(err, errbuf.String()) {
+			return "", &InfraError{Err: fmt.Errorf("%v\n%s", err, errbuf.String())}
+		}
+		return "", fmt.Errorf("[%s] docker build failed: %v\n%s", chall.Name, err, errbuf.String())
+	}
+
+	// `docker build -q` prints only image ID
+	image := strings.TrimSpace(outbuf.String())
+	if len(image) == 0 {
+		image = image_name
+	}
+	return image, nil
+}
+
+/***
+* Check whether failure of `docker` command is caused by unavailable Docker itself.
+***/
+func isCliInfraError(err error, stderr string) bool {
+	if errors.Is(err, exec.ErrNotFound) {
+		return true
+	}
+	return strings.Contains(stderr, "Cannot connect to the Docker daemon") ||
+		strings.Contains(stderr, "permission denied while trying to connect to the Docker daemon")
+}
+
+/***
+* Arguments of `docker run` command.
+***/
+func (r *DockerCliRunner) runArgs(chall Challenge, image string, container string) []string {
+	args := []string{"run", "--name", container, "--rm"}
+
+	// resource limits and network
+	limits := chall.ResourceLimits
+	if limits.Memory > 0 {
+		memory := fmt.Sprintf("%dm", limits.Memory)
+		args = append(args, "--memory", memory, "--memory-swap", memory)
+	}
+	if limits.Cpus > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(limits.Cpus, 'f', -1, 64))
+	}
+	if limits.Pids > 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(limits.Pids, 10))
+	}
+	if limits.isReadOnly() {
+		args = append(args, "--read-only", "--tmpfs", "/tmp")
+	}
+	if len(limits.Network) != 0 {
+		args = append(args, "--network", limits.Network)
+	}
+
+	for _, env := range chall.Environ() {
+		args = append(args, "-e", env)
+	}
+	args = append(args, image)
+	return append(args, chall.CommandArgs()...)
+}
+
+func (r *DockerCliRunner) Run(ctx context.Context, chall Challenge, image string, container string, stdout io.Writer, stderr io.Writer) (int, error) {
+	var errbuf bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker", r.runArgs(chall, image, container)...)
+	// outputs must be set before the command starts
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, &errbuf)
+
+	r.mu.Lock()
+	if err := cmd.Start(); err != nil {
+		r.mu.Unlock()
+		if isCliInfraError(err, "") {
+			return -1, &InfraError{Err: err}
+		}
+		return -1, err
+	}
+	r.procs[container] = cmd
+	r.mu.Unlock()
+
+	err := cmd.Wait()
+
+	r.mu.Lock()
+	delete(r.procs, container)
+	r.mu.Unlock()
+
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				// docker itself exits with 125 when it fails to run container
+				if status.ExitStatus() == 125 && isCliInfraError(err, errbuf.String()) {
+					return -1, &InfraError{Err: fmt.Errorf("%v\n%s", err, errbuf.String())}
+				}
+				return status.ExitStatus(), nil
+			}
+		}
+		return -1, err
+	}
+	return 0, nil
+}
+
+func (r *DockerCliRunner) Kill(container string) error {
+	// remove container first, then `docker run` process exits by itself
+	err := r.Cleanup(container)
+
+	r.mu.Lock()
+	cmd, ok := r.procs[container]
+	r.mu.Unlock()
+	if ok {
+		if kerr := cmd.Process.Kill(); kerr != nil && err == nil {
+			err = kerr
+		}
+	}
+	return err
+}
+
+func (r *DockerCliRunner) Cleanup(container string) error {
+	var errbuf bytes.Buffer
+	cmd := exec.Command("docker", "rm", "-f", container)
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(errbuf.String(), "No such container") {
+			return nil
+		}
+		return fmt.Errorf("Failed to remove container(%s): %v\n%s", container, err, errbuf.String())
+	}
+	return nil
+}
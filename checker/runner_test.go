@@ -0,0 +1,464 @@
+package checker
+
+/***
+* This file implements tests of executer using fake runner.
+* These tests don't need docker.
+***/
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+/***
+* Fake runner which returns prepared exit codes.
+* @exit_codes: exit codes returned by each run. The last one is used once exhausted.
+* @run_errs: errors returned by each run, if any.
+* @stdout: output written to stdout by each run.
+* @hang: if true, runs block until killed.
+* @delay: time each run takes
+* @max_running: max # of runs executed at the same time
+* @self_overlap: whether runs of the same challenge overlapped
+***/
+type fakeRunner struct {
+	mu           sync.Mutex
+	build_err    error
+	exit_codes   []int
+	run_errs     []error
+	stdout       string
+	hang         bool
+	delay        time.Duration
+	runs         int
+	running      int
+	max_running  int
+	by_chall     map[int]int
+	running_id   map[int]bool
+	self_overlap bool
+	killed       map[string]chan bool
+}
+
+func newFakeRunner(exit_codes ...int) *fakeRunner {
+	return &fakeRunner{exit_codes: exit_codes, killed: make(map[string]chan bool), by_chall: make(map[int]int), running_id: make(map[int]bool)}
+}
+
+func (r *fakeRunner) Build(ctx context.Context, chall Challenge) (string, error) {
+	if r.build_err != nil {
+		return "", r.build_err
+	}
+	return fmt.Sprintf("fake_%d", chall.Id), nil
+}
+
+func (r *fakeRunner) Run(ctx context.Context, chall Challenge, image string, container string, stdout io.Writer, stderr io.Writer) (int, error) {
+	r.mu.Lock()
+	exit_code := 0
+	if len(r.exit_codes) > 0 {
+		if r.runs < len(r.exit_codes) {
+			exit_code = r.exit_codes[r.runs]
+		} else {
+			exit_code = r.exit_codes[len(r.exit_codes)-1]
+		}
+	}
+	var run_err error
+	if r.runs < len(r.run_errs) {
+		run_err = r.run_errs[r.runs]
+	}
+	r.runs++
+	r.by_chall[chall.Id]++
+	if r.running_id[chall.Id] {
+		r.self_overlap = true
+	}
+	r.running_id[chall.Id] = true
+	r.running++
+	if r.running > r.max_running {
+		r.max_running = r.running
+	}
+	kill_chan := make(chan bool)
+	r.killed[container] = kill_chan
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.running--
+		r.running_id[chall.Id] = false
+		r.mu.Unlock()
+	}()
+	time.Sleep(r.delay)
+
+	if run_err != nil {
+		return -1, run_err
+	}
+	fmt.Fprint(stdout, r.stdout)
+	fmt.Fprintf(stderr, "fake stderr of %s\n", container)
+	if r.hang {
+		<-kill_chan
+		return 137, nil
+	}
+	return exit_code, nil
+}
+
+func (r *fakeRunner) Kill(container string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if kill_chan, ok := r.killed[container]; ok {
+		close(kill_chan)
+		delete(r.killed, container)
+	}
+	return nil
+}
+
+func (r *fakeRunner) Cleanup(container string) error {
+	return nil
+}
+
+func (r *fakeRunner) numRuns() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.runs
+}
+
+/***
+* Create challenge directory with info.json and exploit/Dockerfile.
+***/
+func createFakeChall(t *testing.T, dir string, info string) string {
+	t.Helper()
+	exploit_dir := filepath.Join(dir, "exploit")
+	if err := os.MkdirAll(exploit_dir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "info.json"), []byte(info), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(exploit_dir, "Dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return dir
+}
+
+func TestFakeRunnerCheck(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challdir := createFakeChall(t, t.TempDir(), `{"name": "fake", "id": 10}`)
+
+	// success
+	runner := newFakeRunner(0)
+	executer := Executer{path: challdir, logger: *slogger, runner: runner}
+	res := make(chan Challenge, 1)
+	executer.Check(context.Background(), res, "info.json")
+	if chall := <-res; chall.Result != TestSuccess {
+		t.Errorf("Test must succeed: %v", chall.Result)
+	}
+
+	// failure is retried for specified times
+	runner = newFakeRunner(1)
+	executer = Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 2}
+	executer.Check(context.Background(), res, "info.json")
+	if chall := <-res; chall.Result != TestFailure {
+		t.Errorf("Test must fail: %v", chall.Result)
+	}
+	if runner.numRuns() != 3 {
+		t.Errorf("Test must be tried 3 times: %d", runner.numRuns())
+	}
+
+	// retry stops once succeeded
+	runner = newFakeRunner(1, 0)
+	executer = Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 5}
+	executer.Check(context.Background(), res, "info.json")
+	if chall := <-res; chall.Result != TestSuccess {
+		t.Errorf("Test must succeed on retry: %v", chall.Result)
+	}
+	if runner.numRuns() != 2 {
+		t.Errorf("Test must be tried 2 times: %d", runner.numRuns())
+	}
+
+	// build failure
+	runner = newFakeRunner(0)
+	runner.build_err = fmt.Errorf("fake build error")
+	executer = Executer{path: challdir, logger: *slogger, runner: runner}
+	executer.Check(context.Background(), res, "info.json")
+	if chall := <-res; chall.Result != TestBuildFailure {
+		t.Errorf("Test must be build failure when build fails: %v", chall.Result)
+	}
+	if runner.numRuns() != 0 {
+		t.Errorf("Solver must not run when build fails: %d", runner.numRuns())
+	}
+
+	// unavailable runner
+	runner = newFakeRunner(0)
+	runner.build_err = &InfraError{Err: fmt.Errorf("fake daemon is down")}
+	executer = Executer{path: challdir, logger: *slogger, runner: runner}
+	executer.Check(context.Background(), res, "info.json")
+	if chall := <-res; chall.Result != TestInfraError {
+		t.Errorf("Test must be infra error when runner is unavailable: %v", chall.Result)
+	}
+
+	// infra errors are not counted as tries of solver
+	runner = newFakeRunner(0, 1, 0)
+	runner.run_errs = []error{&InfraError{Err: fmt.Errorf("fake daemon is down")}}
+	executer = Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 1}
+	executer.Check(context.Background(), res, "info.json")
+	if chall := <-res; chall.Result != TestSuccess {
+		t.Errorf("Test must succeed after infra error and failure: %v", chall.Result)
+	}
+	if runner.numRuns() != 3 {
+		t.Errorf("Test must be tried 3 times: %d", runner.numRuns())
+	}
+}
+
+func TestFakeRunnerInfraBackoff(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challdir := createFakeChall(t, t.TempDir(), `{"name": "fake backoff", "id": 15}`)
+	res := make(chan Challenge, 1)
+	infra_err := &InfraError{Err: fmt.Errorf("fake daemon is down")}
+
+	// backoff doubles on every retry
+	runner := newFakeRunner(0)
+	runner.run_errs = []error{infra_err, infra_err}
+	executer := Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 2, infra_backoff: 100 * time.Millisecond}
+	start := time.Now()
+	executer.Check(context.Background(), res, "info.json")
+	if chall := <-res; chall.Result != TestSuccess {
+		t.Errorf("Test must succeed after infra errors: %v", chall.Result)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Infra errors must be retried after backoff of 100ms and 200ms: %v", elapsed)
+	}
+	if executer.infraBackoff() != 200*time.Millisecond {
+		t.Errorf("Unexpected backoff of the last retry: %v", executer.infraBackoff())
+	}
+	executer.infra_current = 100
+	if executer.infraBackoff() != maxInfraRetryBackoff {
+		t.Errorf("Backoff must be capped: %v", executer.infraBackoff())
+	}
+
+	// backoff is cancelled by ctx
+	runner = newFakeRunner(0)
+	runner.run_errs = []error{infra_err}
+	executer = Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 2, infra_backoff: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	executer.Check(ctx, res, "info.json")
+	if chall := <-res; chall.Result != TestInfraError {
+		t.Errorf("Test must be infra error when cancelled in backoff: %v", chall.Result)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second || runner.numRuns() != 1 {
+		t.Errorf("Backoff must be cancelled without retry: %v, %d runs", elapsed, runner.numRuns())
+	}
+}
+
+func TestFakeRunnerTimeout(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challdir := createFakeChall(t, t.TempDir(), `{"name": "fake timeout", "id": 11, "timeout": 1.0}`)
+
+	runner := newFakeRunner()
+	runner.hang = true
+	executer := Executer{path: challdir, logger: *slogger, runner: runner}
+	res := make(chan Challenge, 1)
+	executer.CheckWithTimeout(context.Background(), res, "info.json", 10.0)
+	if chall := <-res; chall.Result != TestTimeout {
+		t.Errorf("Test must time out: %v", chall.Result)
+	}
+}
+
+func TestFakeRunnerLog(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challdir := createFakeChall(t, t.TempDir(), `{"name": "fake log", "id": 12}`)
+	log_dir := t.TempDir()
+	run_id := NewRunId()
+
+	runner := newFakeRunner(1, 0)
+	runner.stdout = "fake stdout\n"
+	executer := Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 1, run_id: run_id, log_dir: log_dir}
+	res := make(chan Challenge, 1)
+	executer.Check(context.Background(), res, "info.json")
+	chall := <-res
+	if chall.Attempts != 2 || chall.Stdout != "fake stdout\n" {
+		t.Errorf("Outputs of the last try are not captured: %v", chall)
+	}
+
+	// outputs of all tries are persisted
+	log, err := ReadRunLog(log_dir, 12, run_id)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	if strings.Count(string(log), "fake stdout") != 2 || !strings.Contains(string(log), "try 2: TestSuccess") {
+		t.Errorf("Unexpected log:\n%s", log)
+	}
+
+	if _, err := ReadRunLog(log_dir, 12, "../../etc"); err == nil {
+		t.Error("Invalid run ID must be rejected.")
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	buf := newTailBuffer(8)
+	fmt.Fprint(buf, "0123456789")
+	fmt.Fprint(buf, "abc")
+	if buf.String() != "[... 5 bytes truncated ...]\n56789abc" {
+		t.Errorf("Unexpected buffer content: %s", buf.String())
+	}
+}
+
+func TestFakeRunnerFlag(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	res := make(chan Challenge, 1)
+
+	infos := map[string]TestResult{
+		`{"name": "flag", "id": 13, "flag": "TSGCTF{fake}"}`:               TestSuccess,
+		`{"name": "flag", "id": 13, "flag": "TSGCTF{wrong}"}`:              TestWrongFlag,
+		`{"name": "flag", "id": 13, "flag_regex": "TSGCTF\\{[a-z]+\\}"}`:   TestSuccess,
+		`{"name": "flag", "id": 13, "flag_regex": "TSGCTF\\{[0-9]+\\}"}`:   TestWrongFlag,
+		`{"name": "flag", "id": 13, "flag_file": "flag.txt"}`:              TestSuccess,
+		`{"name": "flag", "id": 13, "flag_file": "nonexistent.txt"}`:       TestNotExecuted,
+		`{"name": "flag", "id": 13, "flag_regex": "TSGCTF[", "flag": "x"}`: TestNotExecuted,
+	}
+	for info, expected := range infos {
+		challdir := createFakeChall(t, t.TempDir(), info)
+		if err := ioutil.WriteFile(filepath.Join(challdir, "flag.txt"), []byte("TSGCTF{fake}\n"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		runner := newFakeRunner(0)
+		runner.stdout = "flag is TSGCTF{fake}\n"
+		executer := Executer{path: challdir, logger: *slogger, runner: runner}
+		executer.Check(context.Background(), res, "info.json")
+		chall := <-res
+		if chall.Result != expected {
+			t.Errorf("Unexpected result for %s: %v", info, chall.Result)
+		}
+		// flags must not be left in outputs
+		if strings.Contains(chall.Stdout, "TSGCTF{fake}") && chall.Result == TestSuccess {
+			t.Errorf("Flag is not redacted: %s", chall.Stdout)
+		}
+	}
+}
+
+func TestChallengeEnviron(t *testing.T) {
+	conf := CheckerConfig{Host: "staging.example.com", Port: 1337, Env: map[string]string{"TOKEN": "global", "DEBUG": "1"}}
+	chall := Challenge{Port: 31337, Env: map[string]string{"TOKEN": "local"}, Args: []string{"--target", "${CHALL_HOST}:$CHALL_PORT"}}
+	chall.applyDefaults(conf)
+
+	environ := strings.Join(chall.Environ(), " ")
+	if environ != "CHALL_HOST=staging.example.com CHALL_PORT=31337 DEBUG=1 TOKEN=local" {
+		t.Errorf("Unexpected environment variables: %s", environ)
+	}
+	args := strings.Join(NewDockerCliRunner().runArgs(chall, "image", "container"), " ")
+	if args != "run --name container --rm -e CHALL_HOST=staging.example.com -e CHALL_PORT=31337 -e DEBUG=1 -e TOKEN=local image --target staging.example.com:31337" {
+		t.Errorf("Unexpected arguments of docker run: %s", args)
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	readonly := true
+	conf := CheckerConfig{ResourceLimits: ResourceLimits{Memory: 256, Pids: 64, ReadOnly: &readonly, Network: "challs"}}
+	not_readonly := false
+	chall := Challenge{ResourceLimits: ResourceLimits{Memory: 512, Cpus: 0.5, ReadOnly: &not_readonly}}
+	chall.applyDefaults(conf)
+
+	args := strings.Join(NewDockerCliRunner().runArgs(chall, "image", "container"), " ")
+	if args != "run --name container --rm --memory 512m --memory-swap 512m --cpus 0.5 --pids-limit 64 --network challs image" {
+		t.Errorf("Unexpected arguments of docker run: %s", args)
+	}
+
+	chall = Challenge{}
+	chall.applyDefaults(conf)
+	host_config := fmt.Sprint(hostConfig(chall.ResourceLimits))
+	if host_config != "map[Memory:268435456 MemorySwap:268435456 NetworkMode:challs PidsLimit:64 ReadonlyRootfs:true Tmpfs:map[/tmp:]]" {
+		t.Errorf("Unexpected host config: %s", host_config)
+	}
+}
+
+func TestFakeRunnerAbort(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challdir := createFakeChall(t, t.TempDir(), `{"name": "fake abort", "id": 14}`)
+
+	runner := newFakeRunner()
+	runner.hang = true
+	executer := Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	res := make(chan Challenge, 1)
+	executer.CheckWithTimeout(ctx, res, "info.json", 10.0)
+	if chall := <-res; chall.Result != TestAborted {
+		t.Errorf("Test must be aborted: %v", chall.Result)
+	}
+	// aborted test is killed and never retried
+	if runner.numRuns() != 1 || len(runner.killed) != 0 {
+		t.Errorf("Aborted test must be killed without retry: %d runs", runner.numRuns())
+	}
+}
+
+func TestFakeRunnerRecordFields(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challdir := createFakeChall(t, t.TempDir(), `{"name": "fake", "id": 12}`)
+	res := make(chan Challenge, 1)
+	record := func() DbResult {
+		chall := <-res
+		return chall.intoDbResult()
+	}
+
+	// succeeded on the second try
+	runner := newFakeRunner(3, 0)
+	executer := Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 2, run_id: "run-fields"}
+	executer.Check(context.Background(), res, "info.json")
+	result := record()
+	if result.RunId != "run-fields" || result.Attempt != 2 || result.MaxAttempts != 3 || result.ExitCode != 0 || result.Error != "" {
+		t.Errorf("Unexpected record of success: %+v", result)
+	}
+	if len(result.Hostname) == 0 {
+		t.Error("Hostname of checker must be recorded.")
+	}
+
+	// failed in all tries
+	runner = newFakeRunner(3)
+	executer = Executer{path: challdir, logger: *slogger, runner: runner, retry_max: 1, run_id: "run-fields"}
+	executer.Check(context.Background(), res, "info.json")
+	if result := record(); result.Attempt != 2 || result.ExitCode != 3 || result.Error != "exit status 3" {
+		t.Errorf("Unexpected record of failure: %+v", result)
+	}
+
+	// timeout
+	runner = newFakeRunner(0)
+	runner.hang = true
+	executer = Executer{path: challdir, logger: *slogger, runner: runner}
+	executer.CheckWithTimeout(context.Background(), res, "info.json", 1)
+	if result := record(); result.Result != TestTimeout || result.ExitCode != -1 || result.Error != "timed out after 1s" || result.RunMs < 1000 {
+		t.Errorf("Unexpected record of timeout: %+v", result)
+	}
+
+	// build failure records the first line of error
+	runner = newFakeRunner(0)
+	runner.build_err = fmt.Errorf("fake build error\nStep 1/3 : FROM nothing")
+	executer = Executer{path: challdir, logger: *slogger, runner: runner}
+	executer.Check(context.Background(), res, "info.json")
+	if result := record(); result.Attempt != 0 || result.ExitCode != -1 || result.Error != "fake build error" {
+		t.Errorf("Unexpected record of build failure: %+v", result)
+	}
+}
+
+func TestShortError(t *testing.T) {
+	if msg := shortError(strings.Repeat("あ", 100)); len(msg) > maxErrorLength || !utf8.ValidString(msg) {
+		t.Errorf("Error must be shortened at rune boundary: %q", msg)
+	}
+	if msg := shortError("  first line\nsecond line"); msg != "first line" {
+		t.Errorf("Only the first line must be kept: %q", msg)
+	}
+}
@@ -0,0 +1,201 @@
+package checker
+
+/***
+* This file implements scheduler which checks each challenge on its own schedule.
+* Schedule of a challenge is declared in its info.json by either:
+*		- `cron`: standard 5-field cron expression (e.g. `0 * * * *` for every hour)
+*		- `interval`: minutes between the end of a check and the start of the next one
+* If neither is declared, `interval` of checker config is used.
+* A challenge never runs concurrently with itself, and # of running checks is bounded by pool size.
+***/
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Interval to re-enumerate challenges directory to find added/removed challenges.
+const rescanInterval = time.Minute
+
+/***
+* Schedule state of a challenge.
+* @next: time when the next check starts
+* @running: whether the check is running (or waiting for a free worker)
+***/
+type challSchedule struct {
+	challdir string
+	next     time.Time
+	running  bool
+}
+
+/***
+* Compute the time of the next check of the challenge finished at `now`.
+***/
+func (c *Checker) nextCheckTime(challdir string, now time.Time) time.Time {
+	interval := time.Duration(c.conf.Interval) * time.Minute
+
+	chall, err := readChallengeInfo(challdir, c.conf.Infofile)
+	if err == nil {
+		if len(chall.Cron) != 0 {
+			if sched, err := cron.ParseStandard(chall.Cron); err == nil {
+				return sched.Next(now).Add(c.jitter())
+			} else {
+				c.logger.Warnf("[%s] Invalid cron expression, falling back to interval: %v", chall.Name, err)
+			}
+		}
+		if chall.Interval > 0 {
+			interval = time.Duration(chall.Interval * float64(time.Minute))
+		}
+	}
+
+	return now.Add(interval).Add(c.jitter())
+}
+
+/***
+* Random delay added to schedules, so that checks don't start at the same time.
+***/
+func (c *Checker) jitter() time.Duration {
+	if c.conf.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Float64() * c.conf.Jitter * float64(time.Second))
+}
+
+/***
+* Reflect added and removed challenges into schedules.
+* Newly found challenges are checked soon.
+***/
+func (c *Checker) rescan(schedules map[string]*challSchedule, now time.Time) {
+	challs, err := enumerateChallsDir(c.conf.ChallsDir)
+	if err != nil {
+		c.logger.Warnf("Failed to enumerate challenges: %v", err)
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, challdir := range challs {
+		found[challdir] = true
+		if _, ok := schedules[challdir]; !ok {
+			c.logger.Infof("Challenge found: %s", filepath.Base(challdir))
+			schedules[challdir] = &challSchedule{challdir: challdir, next: now.Add(c.jitter())}
+		}
+	}
+	for challdir, sched := range schedules {
+		if !found[challdir] && !sched.running {
+			c.logger.Infof("Challenge removed: %s", filepath.Base(challdir))
+			delete(schedules, challdir)
+		}
+	}
+}
+
+/***
+* Check challenges endlessly on their own schedules until ctx is cancelled.
+* On cancel, running checks are aborted and recorded, then it returns.
+* Old results are pruned by retention policy periodically.
+* Alerts queued by batch notifiers are flushed every digest interval, so that a digest has alerts of all checks in the window.
+***/
+func (c *Checker) Run(ctx context.Context) error {
+	type sched_result struct {
+		challdir string
+		chall    Challenge
+		done     bool
+	}
+	schedules := make(map[string]*challSchedule)
+	results := make(chan sched_result)
+	workers := make(chan struct{}, c.numWorkers())
+	in_flight := 0
+
+	// dispatch a check of the challenge to worker
+	dispatch := func(sched *challSchedule) {
+		sched.running = true
+		in_flight++
+		go func() {
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				results <- sched_result{challdir: sched.challdir}
+				return
+			}
+			defer func() { <-workers }()
+
+			run_id := NewRunId()
+			res := make(chan Challenge, 1)
+			c.newExecuter(sched.challdir, run_id).CheckWithTimeout(ctx, res, c.conf.Infofile, c.conf.Timeout)
+			results <- sched_result{challdir: sched.challdir, chall: <-res, done: true}
+		}()
+	}
+
+	// handle a finished check
+	finish := func(result sched_result) {
+		in_flight--
+		if result.done {
+			c.logger.Infof("[%s] Test execution finish with %v.", result.chall.Name, result.chall.Result)
+			c.record(result.chall)
+		}
+		if sched, ok := schedules[result.challdir]; ok {
+			sched.running = false
+			sched.next = c.nextCheckTime(sched.challdir, time.Now())
+			c.logger.Infof("[%s] Next check at %v.", filepath.Base(sched.challdir), sched.next.Format(time.RFC3339))
+		}
+	}
+
+	c.rescan(schedules, time.Now())
+	last_scan := time.Now()
+	var last_prune time.Time
+	digest_interval := c.conf.Alert.digestInterval()
+	last_flush := time.Now()
+	for {
+		now := time.Now()
+		if now.Sub(last_scan) >= rescanInterval {
+			c.rescan(schedules, now)
+			last_scan = now
+		}
+		// apply retention policy
+		if c.conf.Days > 0 && now.Sub(last_prune) >= pruneInterval {
+			if _, err := c.Prune(); err != nil {
+				c.logger.Warnf("Failed to prune results: %v", err)
+			}
+			last_prune = now
+		}
+		// deliver digest of alerts in the window
+		if c.alerter != nil && now.Sub(last_flush) >= digest_interval {
+			c.alerter.Flush()
+			last_flush = now
+		}
+
+		// start due checks, and sleep until the next one
+		wait := rescanInterval - now.Sub(last_scan)
+		if until := digest_interval - now.Sub(last_flush); c.alerter != nil && until < wait {
+			wait = until
+		}
+		for _, sched := range schedules {
+			if sched.running {
+				continue
+			}
+			if !sched.next.After(now) {
+				dispatch(sched)
+			} else if until := sched.next.Sub(now); until < wait {
+				wait = until
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// wait for running checks to be aborted and recorded
+			for in_flight > 0 {
+				finish(<-results)
+			}
+			return ctx.Err()
+		case result := <-results:
+			finish(result)
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,105 @@
+package checker
+
+/***
+* This file implements tests of scheduler using fake runner.
+***/
+
+import (
+	"context"
+	"crypto/tls"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestScheduleRun(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challs_dir := t.TempDir()
+	// check every 120ms and every 1 hour
+	createFakeChall(t, filepath.Join(challs_dir, "fast"), `{"name": "fast", "id": 0, "interval": 0.002}`)
+	createFakeChall(t, filepath.Join(challs_dir, "slow"), `{"name": "slow", "id": 1, "interval": 60}`)
+
+	runner := newFakeRunner(0)
+	runner.delay = 100 * time.Millisecond
+	conf := CheckerConfig{Parallel: true, ParallelNum: 2, Infofile: "info.json", Nodb: true, ChallsDir: challs_dir, Interval: 1}
+	checker := Checker{logger: *slogger, conf: conf, runner: runner}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	checker.Run(ctx)
+
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if runner.by_chall[0] < 4 {
+		t.Errorf("Fast challenge must be checked many times: %d", runner.by_chall[0])
+	}
+	if runner.by_chall[1] != 1 {
+		t.Errorf("Slow challenge must be checked only once: %d", runner.by_chall[1])
+	}
+	if runner.self_overlap {
+		t.Error("Challenge must not run concurrently with itself.")
+	}
+}
+
+func TestScheduleRunDigest(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challs_dir := t.TempDir()
+	createFakeChall(t, filepath.Join(challs_dir, "pwn"), `{"name": "pwn-1", "id": 0, "interval": 60}`)
+	createFakeChall(t, filepath.Join(challs_dir, "web"), `{"name": "web-1", "id": 1, "interval": 60}`)
+
+	cert, pool := selfSignedCert(t)
+	server := newSmtpStandIn(t, cert)
+	email_conf := EmailConfig{Host: "127.0.0.1", Port: server.port(), From: "status@example.com", To: []string{"admin@example.com"}, Digest: true, DigestInterval: 0.5}
+	email, err := NewEmailNotifier(email_conf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	email.tls_config = &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+	alerter := NewAlerterWithNotifiers(*slogger, 1, []Notifier{&EmailDigestNotifier{EmailNotifier: email}})
+
+	// both challenges fail at different times in the first window
+	runner := newFakeRunner(1)
+	runner.delay = 100 * time.Millisecond
+	conf := CheckerConfig{Infofile: "info.json", Nodb: true, ChallsDir: challs_dir, Interval: 1, Alert: AlertConfig{Email: &email_conf}}
+	checker := Checker{logger: *slogger, conf: conf, runner: runner, alerter: alerter}
+	ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
+	defer cancel()
+	checker.Run(ctx)
+	alerter.wg.Wait()
+
+	received := server.received()
+	if len(received) != 1 {
+		t.Fatalf("Alerts in a window must be sent in one digest: %d messages", len(received))
+	}
+	if _, body := parseMessage(t, received[0].data); !strings.Contains(body, "pwn-1 is failing") || !strings.Contains(body, "web-1 is failing") {
+		t.Errorf("Digest must have alerts of both challenges:\n%s", body)
+	}
+}
+
+func TestScheduleNextCheckTime(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	slogger := logger.Sugar()
+	challs_dir := t.TempDir()
+	cron_dir := createFakeChall(t, filepath.Join(challs_dir, "cron"), `{"name": "cron", "id": 0, "cron": "0 * * * *", "interval": 5}`)
+	interval_dir := createFakeChall(t, filepath.Join(challs_dir, "interval"), `{"name": "interval", "id": 1, "interval": 5}`)
+	default_dir := createFakeChall(t, filepath.Join(challs_dir, "default"), `{"name": "default", "id": 2}`)
+
+	checker := Checker{logger: *slogger, conf: CheckerConfig{Infofile: "info.json", Interval: 30, Jitter: 10}}
+	now := time.Date(2021, 11, 1, 12, 34, 0, 0, time.Local)
+
+	next := checker.nextCheckTime(cron_dir, now)
+	if next.Before(time.Date(2021, 11, 1, 13, 0, 0, 0, time.Local)) || next.After(time.Date(2021, 11, 1, 13, 0, 10, 0, time.Local)) {
+		t.Errorf("Unexpected next time of cron schedule: %v", next)
+	}
+	if next := checker.nextCheckTime(interval_dir, now); next.Sub(now) < 5*time.Minute || next.Sub(now) > 5*time.Minute+10*time.Second {
+		t.Errorf("Unexpected next time of interval schedule: %v", next)
+	}
+	if next := checker.nextCheckTime(default_dir, now); next.Sub(now) < 30*time.Minute || next.Sub(now) > 30*time.Minute+10*time.Second {
+		t.Errorf("Unexpected next time of default schedule: %v", next)
+	}
+}
@@ -0,0 +1,355 @@
+package checker
+
+/***
+* This file implements availability statistics of challenges.
+* Each test result is regarded as the state of the challenge until the next result,
+* and incidents are derived from transitions between up and down.
+* Results which say nothing about the challenge itself (infra errors and aborted tests) keep the previous state.
+* Periods already rolled into aggregates are computed from # of results in each bucket, because order of results in a bucket is lost.
+* Uptime of a bucket which has both up and down results is apportioned by # of them, and at most one incident is counted for it.
+***/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Returned when the challenge has no result at all.
+var ErrChallengeNotFound = errors.New("challenge not found")
+
+/***
+* State of challenge indicated by a result.
+***/
+type challState int
+
+const (
+	stateUnknown challState = iota
+	stateUp
+	stateDown
+)
+
+func (tr TestResult) state() challState {
+	switch tr {
+	case TestSuccess, TestSuccessWithoutExecution:
+		return stateUp
+	case TestInfraError, TestAborted:
+		return stateUnknown
+	default:
+		return stateDown
+	}
+}
+
+/***
+* Availability of a challenge in a time window.
+* @Uptime, @Downtime: total time the challenge is up and down
+* @Unknown: time when state of the challenge is unknown, such as before the first result
+* @Incidents: # of times the challenge went down, including the one ongoing at the start of window
+* @MTTR: mean time to recover of incidents recovered in the window
+* @Ongoing: whether the challenge is down at the end of window
+* @Checks: # of results in the window
+***/
+type Availability struct {
+	ChallId   int
+	Name      string
+	Since     time.Time
+	Until     time.Time
+	Uptime    time.Duration
+	Downtime  time.Duration
+	Unknown   time.Duration
+	Incidents int
+	MTTR      time.Duration
+	Ongoing   bool
+	Checks    int
+}
+
+/***
+* Whether the challenge is known to be up or down in any part of the window.
+***/
+func (a Availability) Known() bool {
+	return a.Uptime+a.Downtime > 0
+}
+
+/***
+* Percentage of uptime in the known period. 0 if nothing is known, so check `Known` first.
+***/
+func (a Availability) Percentage() float64 {
+	if !a.Known() {
+		return 0
+	}
+	return float64(a.Uptime) / float64(a.Uptime+a.Downtime) * 100
+}
+
+/***
+* Availability in JSON. `availability` is null if nothing is known.
+***/
+func (a Availability) MarshalJSON() ([]byte, error) {
+	var percentage *float64
+	if a.Known() {
+		value := a.Percentage()
+		percentage = &value
+	}
+	return json.Marshal(struct {
+		ChallId         int       `json:"challid"`
+		Name            string    `json:"name"`
+		Since           time.Time `json:"since"`
+		Until           time.Time `json:"until"`
+		Known           bool      `json:"known"`
+		Availability    *float64  `json:"availability"`
+		UptimeSeconds   float64   `json:"uptime_seconds"`
+		DowntimeSeconds float64   `json:"downtime_seconds"`
+		UnknownSeconds  float64   `json:"unknown_seconds"`
+		Incidents       int       `json:"incidents"`
+		MttrSeconds     float64   `json:"mttr_seconds"`
+		Ongoing         bool      `json:"ongoing"`
+		Checks          int       `json:"checks"`
+	}{
+		a.ChallId, a.Name, a.Since, a.Until, a.Known(), percentage,
+		a.Uptime.Seconds(), a.Downtime.Seconds(), a.Unknown.Seconds(),
+		a.Incidents, a.MTTR.Seconds(), a.Ongoing, a.Checks,
+	})
+}
+
+/***
+* Aggregated results of a challenge in a bucket [since, until).
+* @up, @down: # of results which say the challenge is up and down
+***/
+type aggregatedBucket struct {
+	since time.Time
+	until time.Time
+	name  string
+	count int
+	up    int64
+	down  int64
+}
+
+/***
+* Group aggregates by bucket, oldest first.
+***/
+func groupAggregates(aggs []DbAggregate) []aggregatedBucket {
+	type bucketKey struct {
+		bucket      int64
+		granularity string
+	}
+	buckets := make(map[bucketKey]*aggregatedBucket)
+	for _, agg := range aggs {
+		key := bucketKey{bucket: agg.Bucket.Unix(), granularity: agg.Granularity}
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &aggregatedBucket{since: agg.Bucket, until: agg.Bucket.Add(bucketSizes[agg.Granularity])}
+			buckets[key] = bucket
+		}
+		bucket.name = agg.Name
+		bucket.count += int(agg.Count)
+		switch agg.Result.state() {
+		case stateUp:
+			bucket.up += agg.Count
+		case stateDown:
+			bucket.down += agg.Count
+		}
+	}
+
+	sorted := make([]aggregatedBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		sorted = append(sorted, *bucket)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].since.Equal(sorted[j].since) {
+			return sorted[i].since.Before(sorted[j].since)
+		}
+		return sorted[i].until.Before(sorted[j].until)
+	})
+	return sorted
+}
+
+/***
+* Compute availability in [since, until) from aggregates and results ordered by timestamp.
+* Aggregates precede results, because raw results are rolled up from the oldest.
+* The first aggregates or result may be before `since`, which give the state at the start of window.
+***/
+func computeAvailability(challid int, aggs []DbAggregate, results []DbResult, since time.Time, until time.Time) Availability {
+	availability := Availability{ChallId: challid, Since: since, Until: until}
+	state := stateUnknown
+	state_start := since
+	var down_start time.Time
+	var recovered int
+	var recover_total time.Duration
+
+	// account the period from `state_start` to `t` into current state
+	advance := func(t time.Time) {
+		if t.After(until) {
+			t = until
+		}
+		if !t.After(state_start) {
+			return
+		}
+		switch state {
+		case stateUp:
+			availability.Uptime += t.Sub(state_start)
+		case stateDown:
+			availability.Downtime += t.Sub(state_start)
+		default:
+			availability.Unknown += t.Sub(state_start)
+		}
+		state_start = t
+	}
+
+	// change state at `at`, counting incidents and recoveries
+	transit := func(next challState, at time.Time) {
+		if at.Before(since) {
+			at = since
+		}
+		if next == stateDown && state != stateDown {
+			availability.Incidents++
+			down_start = at
+		} else if next == stateUp && state == stateDown && !down_start.IsZero() {
+			recovered++
+			recover_total += at.Sub(down_start)
+		}
+		state = next
+	}
+
+	for _, bucket := range groupAggregates(aggs) {
+		if !bucket.since.Before(until) {
+			break
+		}
+		if len(bucket.name) != 0 {
+			availability.Name = bucket.name
+		}
+		if !bucket.since.Before(since) {
+			availability.Checks += bucket.count
+		}
+		advance(bucket.since)
+
+		switch {
+		case bucket.up+bucket.down == 0:
+			// keeps the previous state
+		case bucket.down == 0:
+			transit(stateUp, bucket.since)
+		case bucket.up == 0:
+			transit(stateDown, bucket.since)
+		default:
+			bucket_until := bucket.until
+			if bucket_until.After(until) {
+				bucket_until = until
+			}
+			if !bucket_until.After(state_start) {
+				// the bucket is before the window, and only tells that the state at the start is unknown
+				state = stateUnknown
+				down_start = time.Time{}
+				continue
+			}
+			length := bucket_until.Sub(state_start)
+			uptime := time.Duration(float64(length) * float64(bucket.up) / float64(bucket.up+bucket.down))
+			availability.Uptime += uptime
+			availability.Downtime += length - uptime
+			state_start = bucket_until
+			// the challenge went down at least once in the bucket, but when it recovered is unknown
+			if state != stateDown {
+				availability.Incidents++
+			}
+			state = stateUnknown
+			down_start = time.Time{}
+		}
+	}
+
+	for _, result := range results {
+		if !result.Timestamp.Before(until) {
+			break
+		}
+		if len(result.Name) != 0 {
+			availability.Name = result.Name
+		}
+		if !result.Timestamp.Before(since) {
+			availability.Checks++
+			advance(result.Timestamp)
+		}
+		if next := result.Result.state(); next != stateUnknown {
+			transit(next, result.Timestamp)
+		}
+	}
+	advance(until)
+
+	availability.Ongoing = state == stateDown
+	if recovered != 0 {
+		availability.MTTR = recover_total / time.Duration(recovered)
+	}
+	return availability
+}
+
+/***
+* Compute availability of the challenge in [since, until).
+* `ErrChallengeNotFound` is returned if the challenge has no result at all.
+***/
+func ComputeAvailability(store ResultStore, challid int, since time.Time, until time.Time) (Availability, error) {
+	if !since.Before(until) {
+		return Availability{}, fmt.Errorf("Start of window must be before its end: %v - %v", since, until)
+	}
+	aggs, results, err := fetchAvailabilityData(store, challid, since, until)
+	if err != nil {
+		return Availability{}, err
+	}
+	if len(aggs) == 0 && len(results) == 0 {
+		// results may be only after the window, or rolled into aggregates before it
+		latest, err := store.FetchResult(challid, 1)
+		if err != nil {
+			return Availability{}, err
+		}
+		old_aggs, err := store.FetchAggregates(challid, time.Time{})
+		if err != nil {
+			return Availability{}, err
+		}
+		if len(latest) == 0 && len(old_aggs) == 0 {
+			return Availability{}, ErrChallengeNotFound
+		}
+	}
+	return computeAvailability(challid, aggs, results, since, until), nil
+}
+
+/***
+* Fetch aggregates and results needed to compute availability in [since, until).
+* Aggregates are fetched from a day (the largest bucket) before `since`, so that the bucket containing `since` is included.
+***/
+func fetchAvailabilityData(store ResultStore, challid int, since time.Time, until time.Time) ([]DbAggregate, []DbResult, error) {
+	aggs, err := store.FetchAggregates(challid, since.Add(-bucketSizes["daily"]))
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := store.FetchResultRange(challid, since, until)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aggs, results, nil
+}
+
+/***
+* Compute availability of each of `segments` equal parts of [since, until), oldest first.
+* Results are fetched only once, which is cheaper than calling `ComputeAvailability` for each part.
+***/
+func ComputeAvailabilitySegments(store ResultStore, challid int, since time.Time, until time.Time, segments int) ([]Availability, error) {
+	if !since.Before(until) || segments <= 0 {
+		return nil, fmt.Errorf("Invalid window or # of segments: %v - %v, %d", since, until, segments)
+	}
+	aggs, results, err := fetchAvailabilityData(store, challid, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	size := until.Sub(since) / time.Duration(segments)
+	availabilities := make([]Availability, 0, segments)
+	first := 0 // index of the last result before start of segment
+	for i := 0; i < segments; i++ {
+		seg_since := since.Add(size * time.Duration(i))
+		seg_until := seg_since.Add(size)
+		if i == segments-1 {
+			seg_until = until
+		}
+		for first+1 < len(results) && results[first+1].Timestamp.Before(seg_since) {
+			first++
+		}
+		availabilities = append(availabilities, computeAvailability(challid, aggs, results[first:], seg_since, seg_until))
+	}
+	return availabilities, nil
+}
@@ -0,0 +1,183 @@
+package checker
+
+/***
+* This file implements tests of availability statistics.
+***/
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeAvailability(t *testing.T) {
+	since := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(100 * time.Minute)
+	at := func(minutes int, result TestResult) DbResult {
+		return DbResult{ChallId: 1, Name: "pwn-3", Result: result, Timestamp: since.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	// up at the start, and three incidents
+	results := []DbResult{
+		at(-10, TestSuccess), at(10, TestFailure), at(20, TestInfraError), at(30, TestSuccess),
+		at(50, TestTimeout), at(60, TestWrongFlag), at(70, TestSuccess), at(90, TestBuildFailure),
+	}
+	availability := computeAvailability(1, nil, results, since, until)
+	if availability.Uptime != 50*time.Minute || availability.Downtime != 50*time.Minute || availability.Unknown != 0 {
+		t.Errorf("Unexpected uptime/downtime: %+v", availability)
+	}
+	if availability.Incidents != 3 || availability.MTTR != 20*time.Minute || !availability.Ongoing || availability.Checks != 7 {
+		t.Errorf("Unexpected incidents: %+v", availability)
+	}
+	if availability.Percentage() != 50 || availability.Name != "pwn-3" {
+		t.Errorf("Unexpected availability: %v", availability.Percentage())
+	}
+
+	// down at the start
+	availability = computeAvailability(1, nil, []DbResult{at(-10, TestFailure), at(15, TestSuccess)}, since, until)
+	if availability.Incidents != 1 || availability.Downtime != 15*time.Minute || availability.MTTR != 15*time.Minute || availability.Ongoing {
+		t.Errorf("Incident ongoing at the start must be counted: %+v", availability)
+	}
+
+	// unknown until the first result, and infra errors don't change state
+	availability = computeAvailability(1, nil, []DbResult{at(10, TestAborted), at(20, TestSuccess), at(40, TestInfraError)}, since, until)
+	if availability.Unknown != 20*time.Minute || availability.Uptime != 80*time.Minute || availability.Percentage() != 100 || availability.Incidents != 0 {
+		t.Errorf("Unexpected availability without incidents: %+v", availability)
+	}
+
+	// nothing is known
+	availability = computeAvailability(1, nil, nil, since, until)
+	if availability.Known() || availability.Unknown != 100*time.Minute {
+		t.Errorf("Unexpected availability without results: %+v", availability)
+	}
+	if encoded, _ := json.Marshal(availability); !strings.Contains(string(encoded), `"known":false,"availability":null`) {
+		t.Errorf("Availability must be null if nothing is known: %s", encoded)
+	}
+	if encoded, _ := json.Marshal(computeAvailability(1, nil, results, since, until)); !strings.Contains(string(encoded), `"known":true,"availability":50`) {
+		t.Errorf("Unexpected availability in JSON: %s", encoded)
+	}
+}
+
+func TestComputeAvailabilityAggregates(t *testing.T) {
+	since := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(4 * time.Hour)
+	agg := func(hours int, result TestResult, count int64) DbAggregate {
+		return DbAggregate{ChallId: 1, Name: "pwn-3", Bucket: since.Add(time.Duration(hours) * time.Hour), Granularity: "hourly", Result: result, Count: count}
+	}
+	aggs := []DbAggregate{
+		agg(-1, TestSuccess, 4),
+		agg(0, TestSuccess, 3), agg(0, TestFailure, 1),
+		agg(1, TestFailure, 2), agg(1, TestInfraError, 1),
+	}
+	results := []DbResult{{ChallId: 1, Name: "pwn-3", Result: TestSuccess, Timestamp: since.Add(150 * time.Minute)}}
+
+	// uptime of mixed bucket is apportioned, and down bucket starts an incident recovered by raw result
+	availability := computeAvailability(1, aggs, results, since, until)
+	if availability.Uptime != 135*time.Minute || availability.Downtime != 105*time.Minute || availability.Unknown != 0 {
+		t.Errorf("Unexpected uptime/downtime with aggregates: %+v", availability)
+	}
+	if availability.Incidents != 2 || availability.MTTR != 90*time.Minute || availability.Ongoing || availability.Checks != 8 {
+		t.Errorf("Unexpected incidents with aggregates: %+v", availability)
+	}
+
+	// state at the start of window is given by bucket before it
+	availability = computeAvailability(1, aggs[:1], nil, since, since.Add(time.Hour))
+	if availability.Uptime != time.Hour || availability.Checks != 0 || availability.Name != "pwn-3" {
+		t.Errorf("State before window must be kept: %+v", availability)
+	}
+}
+
+func TestStoreAvailability(t *testing.T) {
+	sqlite, err := OpenStore("sqlite", filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	defer sqlite.Close()
+
+	since := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	until := since.Add(time.Hour)
+	for name, store := range map[string]ResultStore{"sqlite": sqlite, "memory": NewMemoryStore()} {
+		putOldResults(t, store, []DbResult{
+			{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: since.Add(-2 * time.Hour)},
+			{ChallId: 1, Name: "a", Result: TestFailure, Timestamp: since.Add(-time.Hour)},
+			{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: since.Add(15 * time.Minute)},
+			{ChallId: 1, Name: "a", Result: TestFailure, Timestamp: until.Add(time.Minute)},
+			{ChallId: 2, Name: "b", Result: TestSuccess, Timestamp: since.Add(time.Minute)},
+		})
+
+		availability, err := ComputeAvailability(store, 1, since, until)
+		if err != nil {
+			t.Fatalf("[%s] Failed to compute availability: %v", name, err)
+		}
+		if availability.Downtime != 15*time.Minute || availability.Uptime != 45*time.Minute || availability.Incidents != 1 || availability.Checks != 1 {
+			t.Errorf("[%s] Unexpected availability: %+v", name, availability)
+		}
+
+		segments, err := ComputeAvailabilitySegments(store, 1, since, until, 4)
+		if err != nil || len(segments) != 4 {
+			t.Fatalf("[%s] Failed to compute availability of segments: %v", name, err)
+		}
+		if segments[0].Downtime != 15*time.Minute || segments[0].Incidents != 1 || segments[1].Percentage() != 100 || segments[3].Until != until {
+			t.Errorf("[%s] Unexpected availability of segments: %+v", name, segments)
+		}
+
+		latest, err := store.FetchLatestResults()
+		if err != nil || len(latest) != 2 || latest[0].ChallId != 1 || latest[0].Result != TestFailure || latest[1].ChallId != 2 {
+			t.Errorf("[%s] Unexpected latest results: %+v, %v", name, latest, err)
+		}
+	}
+
+	if _, err := ComputeAvailability(NewMemoryStore(), 1, time.Now(), time.Now().Add(-time.Hour)); err == nil {
+		t.Error("Reversed window must be rejected.")
+	}
+
+	// challenge which has results only after the window exists, but unknown one doesn't
+	store := NewMemoryStore()
+	putOldResults(t, store, []DbResult{{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: until.Add(time.Minute)}})
+	if availability, err := ComputeAvailability(store, 1, since, until); err != nil || availability.Known() {
+		t.Errorf("Challenge without results in the window must be unknown: %+v, %v", availability, err)
+	}
+	if _, err := ComputeAvailability(store, 2, since, until); !errors.Is(err, ErrChallengeNotFound) {
+		t.Errorf("Challenge without results must not be found: %v", err)
+	}
+}
+
+func TestStoreAvailabilityPruned(t *testing.T) {
+	sqlite, err := OpenStore("sqlite", filepath.Join(t.TempDir(), "status.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	defer sqlite.Close()
+
+	now := time.Now()
+	cutoff := RetentionPolicy{Days: 1}.cutoff(now)
+	since := cutoff.Add(-2 * time.Hour)
+	for name, store := range map[string]ResultStore{"sqlite": sqlite, "memory": NewMemoryStore()} {
+		putOldResults(t, store, []DbResult{
+			{ChallId: 1, Name: "a", Result: TestFailure, Timestamp: since.Add(10 * time.Minute).Local()},
+			{ChallId: 1, Name: "a", Result: TestFailure, Timestamp: since.Add(70 * time.Minute).Local()},
+			{ChallId: 1, Name: "a", Result: TestSuccess, Timestamp: cutoff.Add(30 * time.Minute).Local()},
+			{ChallId: 2, Name: "b", Result: TestSuccess, Timestamp: since.Add(10 * time.Minute).Local()},
+		})
+		if pruned, err := store.Prune(cutoff, "hourly"); err != nil || pruned != 3 {
+			t.Fatalf("[%s] Old results must be pruned: %d, %v", name, pruned, err)
+		}
+
+		// pruned part of the window is known from aggregates
+		availability, err := ComputeAvailability(store, 1, since, cutoff.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("[%s] Failed to compute availability: %v", name, err)
+		}
+		if availability.Downtime != 150*time.Minute || availability.Uptime != 30*time.Minute || availability.Unknown != 0 || availability.Checks != 3 {
+			t.Errorf("[%s] Unexpected availability over pruned results: %+v", name, availability)
+		}
+
+		// challenge whose results are all pruned still exists
+		if _, err := ComputeAvailability(store, 2, now.Add(-time.Hour), now); err != nil {
+			t.Errorf("[%s] Challenge with only aggregates must be found: %v", name, err)
+		}
+	}
+}
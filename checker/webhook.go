@@ -0,0 +1,180 @@
+package checker
+
+/***
+* This file implements notifier which posts alerts in JSON to webhook URLs.
+* Payload is formatted by `format` of the config (see alert_format.go).
+* Failed deliveries are retried with exponential backoff, unless the endpoint rejects the request (4xx except 429).
+***/
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultWebhookRetries = 3
+	defaultWebhookBackoff = 1.0
+	defaultWebhookTimeout = 10.0
+	// Upper bound of wait between retries.
+	maxWebhookBackoff = 5 * time.Minute
+)
+
+/***
+* Config of a webhook.
+* @Format: payload format (`json`, `discord` or `slack`)
+* @Headers: additional HTTP headers (e.g. Authorization)
+* @Retries: max # of retries after the first delivery fails (default 3, negative for no retry)
+* @Backoff: seconds to wait before the first retry, which doubles for each retry (default 1)
+* @Timeout: seconds to wait for response of each request (default 10)
+***/
+type WebhookConfig struct {
+	Url     string            `json:"url"`
+	Format  string            `json:"format"`
+	Headers map[string]string `json:"headers"`
+	Retries int               `json:"retries"`
+	Backoff float64           `json:"backoff"`
+	Timeout float64           `json:"timeout"`
+}
+
+/***
+* Notifier posting alerts to a webhook.
+***/
+type WebhookNotifier struct {
+	conf    WebhookConfig
+	client  *http.Client
+	format  func(Alert) ([]byte, error)
+	retries int
+	backoff time.Duration
+}
+
+func NewWebhookNotifier(conf WebhookConfig) (*WebhookNotifier, error) {
+	u, err := url.Parse(conf.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Invalid URL of webhook: %s", conf.Url)
+	}
+	format, ok := webhookFormats[conf.Format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown format of webhook: %s", conf.Format)
+	}
+
+	retries := conf.Retries
+	if retries == 0 {
+		retries = defaultWebhookRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	backoff := conf.Backoff
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	return &WebhookNotifier{
+		conf:    conf,
+		client:  &http.Client{Timeout: time.Duration(timeout * float64(time.Second))},
+		format:  format,
+		retries: retries,
+		backoff: time.Duration(backoff * float64(time.Second)),
+	}, nil
+}
+
+/***
+* Only scheme and host are shown, because path of webhook URL often contains secret token.
+***/
+func (n *WebhookNotifier) String() string {
+	u, _ := url.Parse(n.conf.Url)
+	return fmt.Sprintf("webhook %s://%s", u.Scheme, u.Host)
+}
+
+/***
+* Error of a delivery.
+* @retry_after: wait requested by the endpoint (0 if not requested)
+***/
+type deliveryError struct {
+	err         error
+	retryable   bool
+	retry_after time.Duration
+}
+
+func (e *deliveryError) Error() string {
+	return e.err.Error()
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	body, err := n.format(alert)
+	if err != nil {
+		return err
+	}
+
+	wait := n.backoff
+	for attempt := 0; ; attempt++ {
+		derr := n.post(ctx, body)
+		if derr == nil {
+			return nil
+		}
+		if !derr.retryable || attempt >= n.retries {
+			return fmt.Errorf("%w (after %d attempts)", derr, attempt+1)
+		}
+
+		delay := wait
+		if derr.retry_after > delay {
+			delay = derr.retry_after
+		}
+		if delay > maxWebhookBackoff {
+			delay = maxWebhookBackoff
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+/***
+* Post body to the webhook once.
+***/
+func (n *WebhookNotifier) post(ctx context.Context, body []byte) *deliveryError {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.conf.Url, bytes.NewReader(body))
+	if err != nil {
+		return &deliveryError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "skbctf-status")
+	for key, value := range n.conf.Headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		// network errors and timeouts
+		return &deliveryError{err: err, retryable: ctx.Err() == nil}
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	derr := &deliveryError{
+		err:       fmt.Errorf("Webhook responded with %s", res.Status),
+		retryable: res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500,
+	}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		derr.retry_after = time.Duration(seconds) * time.Second
+	}
+	return derr
+}
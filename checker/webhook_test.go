@@ -0,0 +1,92 @@
+package checker
+
+/***
+* This file implements tests of webhook notifier.
+***/
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/***
+* Start webhook stand-in which responds with `statuses` in order, then 204.
+***/
+func webhookStandIn(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if int(n) <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestWebhookRetry(t *testing.T) {
+	alert := Alert{Kind: AlertFailing, ChallId: 1, Name: "pwn-1"}
+	conf := func(url string, retries int) WebhookConfig {
+		return WebhookConfig{Url: url, Headers: map[string]string{"X-Token": "secret"}, Retries: retries, Backoff: 0.01}
+	}
+
+	// retried on server errors until success
+	server, requests := webhookStandIn(t, http.StatusInternalServerError, http.StatusBadGateway)
+	notifier, err := NewWebhookNotifier(conf(server.URL, 3))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	start := time.Now()
+	if err := notifier.Notify(context.Background(), alert); err != nil || atomic.LoadInt32(requests) != 3 {
+		t.Errorf("Delivery must succeed after retries: %v, %d requests", err, atomic.LoadInt32(requests))
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Retries must back off: %v", elapsed)
+	}
+
+	// gives up after retries
+	server, requests = webhookStandIn(t, 500, 500, 500)
+	notifier, _ = NewWebhookNotifier(conf(server.URL, 1))
+	if err := notifier.Notify(context.Background(), alert); err == nil || atomic.LoadInt32(requests) != 2 {
+		t.Errorf("Delivery must fail after retries: %v, %d requests", err, atomic.LoadInt32(requests))
+	}
+
+	// client errors are not retried
+	server, requests = webhookStandIn(t, http.StatusNotFound)
+	notifier, _ = NewWebhookNotifier(conf(server.URL, 3))
+	if err := notifier.Notify(context.Background(), alert); err == nil || atomic.LoadInt32(requests) != 1 {
+		t.Errorf("Client error must not be retried: %v, %d requests", err, atomic.LoadInt32(requests))
+	}
+
+	// cancelled while backing off
+	server, _ = webhookStandIn(t, http.StatusTooManyRequests)
+	notifier, _ = NewWebhookNotifier(WebhookConfig{Url: server.URL, Headers: map[string]string{"X-Token": "secret"}, Backoff: 10})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := notifier.Notify(ctx, alert); err != context.DeadlineExceeded {
+		t.Errorf("Delivery must be cancelled: %v", err)
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	for _, url := range []string{"", "ftp://example.com/", "http://", "://example.com"} {
+		if _, err := NewWebhookNotifier(WebhookConfig{Url: url}); err == nil {
+			t.Errorf("Invalid URL must be rejected: %s", url)
+		}
+	}
+	notifier, err := NewWebhookNotifier(WebhookConfig{Url: "https://discord.com/api/webhooks/1/token", Retries: -1})
+	if err != nil || notifier.retries != 0 || notifier.String() != "webhook https://discord.com" {
+		t.Errorf("Unexpected notifier: %v, %v", notifier, err)
+	}
+}
@@ -9,8 +9,10 @@ require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/jmoiron/sqlx v1.3.4 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/lib/pq v1.10.4
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/ugorji/go v1.2.6 // indirect
 	github.com/xeonx/timeago v1.0.0-rc4 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
@@ -21,4 +23,5 @@ require (
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
+	modernc.org/sqlite v1.14.6
 )
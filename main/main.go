@@ -6,12 +6,17 @@ package main
 *		- parse command-line options.
 *		- read and parse config file.
 *		- run tests only once or endlessly.
+*		- apply schema migrations of result store by `migrate` subcommand.
+*		- apply retention policy of results by `prune` subcommand.
 ***/
 
 import (
+	"context"
 	"flag"
 	"log"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/smallkirby/skbctf-status/checker"
 	"go.uber.org/zap"
@@ -27,9 +32,25 @@ func create_conf(logger zap.SugaredLogger) checker.CheckerConfig {
 	pnum := flag.Uint("pnum", 0, "Max number of paralleled tests.")
 	infofile := flag.String("infofile", "info.json", "File name of configuration file for each challs.")
 	nodb := flag.Bool("nodb", false, "Not write to DB.")
+	db_driver := flag.String("dbdriver", "mysql", "Storage of test results. (mysql, postgres, sqlite, memory, jsonfile)")
+	snapshot := flag.String("snapshot", "", "JSONL file where results are snapshotted in nodb mode. (kept only in memory if empty)")
+	db_dsn := flag.String("dbdsn", "", "Data source of storage. (mysql: DSN, or $DBUSER, $DBPASS, $DBHOST and $DBNAME are used if empty. postgres: connection string. sqlite: path to DB file. jsonfile: path to snapshot file. memory: unused)")
 	challs_dir := flag.String("challs", "examples", "Challenges directory path.")
-	interval := flag.Uint("interval", 30, "Testing interval in minutes.")
+	interval := flag.Uint("interval", 30, "Default testing interval of each challenge in minutes.")
+	jitter := flag.Float64("jitter", 30, "Max random delay in seconds added to schedules of challenges.")
 	retries := flag.Uint("retry", 0, "Number of retries when a test fails.")
+	runner := flag.String("runner", "cli", "Backend to run solvers. (cli: Docker CLI, api: Docker Engine API)")
+	host := flag.String("host", "", "Default host of challenge servers passed to solvers as $CHALL_HOST.")
+	port := flag.Int("port", 0, "Default port of challenge servers passed to solvers as $CHALL_PORT.")
+	memory := flag.Int64("memory", 0, "Default memory limit of solvers in MiB. (0 means no limit)")
+	cpus := flag.Float64("cpus", 0, "Default number of CPUs solvers can use. (0 means no limit)")
+	pids := flag.Int64("pids", 0, "Default max number of processes in solvers. (0 means no limit)")
+	readonly := flag.Bool("readonly", false, "Mount root filesystem of solvers as read-only by default.")
+	network := flag.String("network", "", "Default Docker network solvers attach to.")
+	retention := flag.Float64("retention", 0, "Days to keep raw test results, after which they're rolled into aggregates. (kept forever if 0)")
+	downsample := flag.String("downsample", "hourly", "Granularity of aggregates of old test results. (hourly, daily)")
+	log_dir := flag.String("logdir", "", "Directory to persist solver outputs. (not persisted if empty)")
+	docker_sock := flag.String("dockersock", "", "Unix socket of Docker daemon used by `api` runner. (defaults to $DOCKER_HOST or /var/run/docker.sock)")
 	flag.Parse()
 
 	// create default config
@@ -40,14 +61,30 @@ func create_conf(logger zap.SugaredLogger) checker.CheckerConfig {
 
 		// use default values
 		conf.Nodb = *nodb
+		conf.DbDriver = *db_driver
+		conf.DbDsn = *db_dsn
+		conf.Snapshot = *snapshot
 		conf.Parallel = *parallel
 		conf.Single = *single
 		conf.Timeout = *timeout
 		conf.Infofile = *infofile
 		conf.ChallsDir = *challs_dir
 		conf.Interval = *interval
+		conf.Jitter = *jitter
 		conf.Retries = *retries
 		conf.ParallelNum = *pnum
+		conf.Runner = *runner
+		conf.DockerSock = *docker_sock
+		conf.LogDir = *log_dir
+		conf.Host = *host
+		conf.Port = *port
+		conf.Memory = *memory
+		conf.Cpus = *cpus
+		conf.Pids = *pids
+		conf.ReadOnly = readonly
+		conf.Network = *network
+		conf.Days = *retention
+		conf.Granularity = *downsample
 	}
 
 	// Overwrite with command-line options
@@ -56,6 +93,15 @@ func create_conf(logger zap.SugaredLogger) checker.CheckerConfig {
 		case "nodb":
 			conf.Nodb = *nodb
 			break
+		case "dbdriver":
+			conf.DbDriver = *db_driver
+			break
+		case "dbdsn":
+			conf.DbDsn = *db_dsn
+			break
+		case "snapshot":
+			conf.Snapshot = *snapshot
+			break
 		case "timeout":
 			conf.Timeout = *timeout
 			break
@@ -71,6 +117,9 @@ func create_conf(logger zap.SugaredLogger) checker.CheckerConfig {
 		case "interval":
 			conf.Interval = *interval
 			break
+		case "jitter":
+			conf.Jitter = *jitter
+			break
 		case "config":
 			break
 		case "retry":
@@ -79,6 +128,42 @@ func create_conf(logger zap.SugaredLogger) checker.CheckerConfig {
 		case "pnum":
 			conf.ParallelNum = *pnum
 			break
+		case "runner":
+			conf.Runner = *runner
+			break
+		case "dockersock":
+			conf.DockerSock = *docker_sock
+			break
+		case "logdir":
+			conf.LogDir = *log_dir
+			break
+		case "host":
+			conf.Host = *host
+			break
+		case "port":
+			conf.Port = *port
+			break
+		case "memory":
+			conf.Memory = *memory
+			break
+		case "cpus":
+			conf.Cpus = *cpus
+			break
+		case "pids":
+			conf.Pids = *pids
+			break
+		case "readonly":
+			conf.ReadOnly = readonly
+			break
+		case "network":
+			conf.Network = *network
+			break
+		case "retention":
+			conf.Days = *retention
+			break
+		case "downsample":
+			conf.Granularity = *downsample
+			break
 		default:
 			logger.Errorf("Unknown flag found: %s", f.Name)
 		}
@@ -95,19 +180,54 @@ func main() {
 	if err != nil {
 		log.Fatalf("[!] failed to init logger:\n%s", err)
 	}
+	defer logger.Sync()
 	slogger := logger.Sugar()
 
 	conf := create_conf(*slogger)
+	status_checker, err := checker.NewChecker(*slogger, conf)
+	if err != nil {
+		slogger.Fatalf("Failed to init checker:\n%v", err)
+	}
+	defer status_checker.Close()
 
-	for {
-		if err := checker.CheckAllOnce(*slogger, conf); err != nil {
-			slogger.Warnf("Fatal error detected:\n%v", err)
+	// `main [options] migrate` only applies migrations and exits
+	if flag.Arg(0) == "migrate" {
+		if err := status_checker.Migrate(); err != nil {
+			slogger.Fatalf("Failed to migrate result store:\n%v", err)
+		}
+		return
+	}
+	// `main [options] prune` only applies retention policy and exits
+	if flag.Arg(0) == "prune" {
+		if conf.Days <= 0 {
+			slogger.Fatal("Retention is not configured. Specify `retention` option.")
 		}
+		pruned, err := status_checker.Prune()
+		if err != nil {
+			slogger.Fatalf("Failed to prune results:\n%v", err)
+		}
+		slogger.Infof("%d results are pruned.", pruned)
+		return
+	}
 
-		if conf.Single {
-			break
-		} else {
-			time.Sleep(time.Duration(conf.Interval) * time.Minute)
+	// single shutdown path: on SIGINT/SIGTERM, running tests are aborted and recorded.
+	// second signal kills the process immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		slogger.Info("Shutting down checker, aborting running tests...")
+		stop()
+	}()
+
+	if conf.Single {
+		if _, err := status_checker.CheckAllOnce(ctx); err != nil {
+			slogger.Warnf("Fatal error detected:\n%v", err)
 		}
+	} else {
+		// check each challenge on its own schedule until shutdown
+		status_checker.Run(ctx)
 	}
+
+	slogger.Info("Checker exits.")
 }
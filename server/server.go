@@ -2,48 +2,212 @@ package main
 
 /***
 * This file implements status server.
-* Status server uses `Badger` structure to collect test-result information.
+* Status server uses `Badger` structure to collect test-result information and render badges.
 ***/
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/smallkirby/skbctf-status/badge"
+	"github.com/smallkirby/skbctf-status/checker"
 	"go.uber.org/zap"
 )
 
-func get_port() int {
+/***
+* Options of badge server.
+* @port: port number the server listens to
+* @log_dir: directory where checker persists solver outputs
+* @log_token: bearer token required to read solver outputs. Solver outputs are not served if empty.
+* @db_driver, @db_dsn: storage of test results (see `checker.OpenStore`)
+***/
+type options struct {
+	port      int
+	log_dir   string
+	log_token string
+	db_driver string
+	db_dsn    string
+}
+
+// Default and max # of results returned by results API.
+const (
+	defaultResultsLimit = 20
+	maxResultsLimit     = 1000
+)
+
+/***
+* Challenge in inventory API.
+* @Result, @Status: the latest test result and its message
+* @LastChecked: timestamp of the latest test result
+***/
+type challenge_summary struct {
+	Id          int                `json:"id"`
+	Name        string             `json:"name"`
+	Category    string             `json:"category"`
+	Result      checker.TestResult `json:"result"`
+	Status      string             `json:"status"`
+	LastChecked time.Time          `json:"last_checked"`
+	RunId       string             `json:"runid"`
+}
+
+/***
+* A page of history of a challenge.
+* @NextSince, @NextAfter: `since` and `after` to get the next page, which are timestamp and ID of the last result.
+* NextSince is null if the page has fewer results than limit.
+***/
+type results_page struct {
+	ChallId   int                `json:"challid"`
+	Results   []checker.DbResult `json:"results"`
+	NextSince *time.Time         `json:"next_since"`
+	NextAfter int64              `json:"next_after"`
+}
+
+// Interval to poll result store for events, and to send keep-alive comments to event streams.
+const (
+	eventPollInterval = 2 * time.Second
+	keepAliveInterval = 30 * time.Second
+)
+
+// Default window of availability statistics.
+const defaultStatsWindow = 24 * time.Hour
+
+/***
+* Parse time in query, which is either RFC3339, UNIX time in seconds, or duration before `now` (e.g. `24h`).
+***/
+func parse_time(value string, now time.Time, default_time time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return default_time, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+		return now.Add(-ago), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time: %s", value)
+}
+
+/***
+* Parse window of statistics from `since` and `until` query.
+***/
+func parse_window(c *gin.Context) (time.Time, time.Time, error) {
+	now := time.Now()
+	until, err := parse_time(c.Query("until"), now, now)
+	if err != nil {
+		return until, until, err
+	}
+	since, err := parse_time(c.Query("since"), now, until.Add(-defaultStatsWindow))
+	if err != nil {
+		return since, until, err
+	}
+	if !since.Before(until) {
+		return since, until, fmt.Errorf("`since` must be before `until`.")
+	}
+	return since, until, nil
+}
+
+/***
+* Serve SVG badge with ETag. If it matches `If-None-Match`, only 304 is returned.
+***/
+func serve_svg(c *gin.Context, status int, render func() ([]byte, error)) {
+	svg, err := render()
+	if err != nil {
+		c.String(http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(svg))
+	c.Header("Cache-Control", "max-age=60, public, must-revalidate")
+	c.Header("ETag", etag)
+	if status == http.StatusOK && c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(status, "image/svg+xml; charset=utf-8", svg)
+}
+
+/***
+* Check `Authorization: Bearer <token>` header of the request.
+***/
+func has_bearer_token(c *gin.Context, token string) bool {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func parse_options() options {
 	// priority is command-line > ENVVAR.
-	var port_num int = 0
+	opts := options{}
 	port := flag.Int("port", 8080, "Port number this badge server listens to. (can be specified also by $BADGEPORT envvar.)")
+	log_dir := flag.String("logdir", "", "Directory where checker persists solver outputs. (can be specified also by $LOGDIR envvar.)")
+	log_token := flag.String("logtoken", "", "Bearer token required to read solver outputs, which are not served if empty. (can be specified also by $LOGTOKEN envvar.)")
+	db_driver := flag.String("dbdriver", "mysql", "Storage of test results: mysql, postgres, sqlite, memory or jsonfile. (can be specified also by $DBDRIVER envvar.)")
+	db_dsn := flag.String("dbdsn", "", "Data source of storage: DSN for mysql ($DBUSER, $DBPASS, $DBHOST and $DBNAME are used if empty), connection string for postgres, path to DB file for sqlite, path to snapshot file for jsonfile, unused for memory. (can be specified also by $DBDSN envvar.)")
 	flag.Parse()
 
 	// first, assign command-line value even if it's not specified
-	port_num = *port
+	opts.port = *port
+	opts.log_dir = *log_dir
+	opts.log_token = *log_token
+	opts.db_driver = *db_driver
+	opts.db_dsn = *db_dsn
 
 	// next, check envvar
 	port_str := os.Getenv("BADGEPORT")
 	if len(port_str) != 0 {
 		if port_num_tmp, err := strconv.Atoi(port_str); err == nil {
-			port_num = port_num_tmp
+			opts.port = port_num_tmp
 		}
 	}
+	if log_dir_env := os.Getenv("LOGDIR"); len(log_dir_env) != 0 {
+		opts.log_dir = log_dir_env
+	}
+	if log_token_env := os.Getenv("LOGTOKEN"); len(log_token_env) != 0 {
+		opts.log_token = log_token_env
+	}
+	if db_driver_env := os.Getenv("DBDRIVER"); len(db_driver_env) != 0 {
+		opts.db_driver = db_driver_env
+	}
+	if db_dsn_env := os.Getenv("DBDSN"); len(db_dsn_env) != 0 {
+		opts.db_dsn = db_dsn_env
+	}
 
 	// lastly, overwrite with command-line value if specified
 	flag.Visit(func(f *flag.Flag) {
 		switch f.Name {
 		case "port":
-			port_num = *port
+			opts.port = *port
+		case "logdir":
+			opts.log_dir = *log_dir
+		case "logtoken":
+			opts.log_token = *log_token
+		case "dbdriver":
+			opts.db_driver = *db_driver
+		case "dbdsn":
+			opts.db_dsn = *db_dsn
 		}
 	})
 
-	return port_num
+	return opts
 }
 
 func main() {
@@ -57,16 +221,26 @@ func main() {
 	}
 	logger := _logger.Sugar()
 	logger.Debug("Logger init.")
+	opts := parse_options()
 
 	// get Badger
-	dbuser := os.Getenv("DBUSER")
-	dbpass := os.Getenv("DBPASS")
-	dbhost := os.Getenv("DBHOST")
-	dbname := os.Getenv("DBNAME")
-	badger, err := badge.NewBadger(dbuser, dbpass, dbhost, dbname)
+	store, err := checker.OpenStore(opts.db_driver, opts.db_dsn)
 	if err != nil {
 		logger.Fatalf("%v", err)
 	}
+	if versioned, ok := store.(checker.VersionedStore); ok {
+		if from, to := versioned.SchemaVersions(); from != to {
+			logger.Infof("Schema of result store is migrated from version %d to %d.", from, to)
+		}
+	}
+	badger := badge.NewBadgerWithStore(store)
+	defer badger.Close()
+
+	// watch new results for event streams
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := checker.NewHub()
+	go hub.Watch(ctx, *logger, store, eventPollInterval)
 
 	// init server
 	server := gin.Default()
@@ -78,8 +252,33 @@ func main() {
 		c.String(http.StatusOK, "pong")
 	})
 
+	// status page EP
+	status_page := func(c *gin.Context) {
+		page, err := badger.GetStatusPage(time.Now())
+		if err != nil {
+			logger.Warnf("%v", err)
+			c.String(http.StatusInternalServerError, "Failed to fetch status of challenges.")
+			return
+		}
+		var body bytes.Buffer
+		if err := badge.RenderStatusPage(&body, page); err != nil {
+			logger.Warnf("%v", err)
+			c.String(http.StatusInternalServerError, "Failed to render status page.")
+			return
+		}
+		c.Header("Cache-Control", "max-age=60, public")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", body.Bytes())
+	}
+	server.GET("/", status_page)
+	server.GET("/status", status_page)
+
 	// badge EP
 	server.GET("/badge/:challid", func(c *gin.Context) {
+		style := c.DefaultQuery("style", "flat")
+		if !badge.IsValidStyle(style) {
+			c.String(http.StatusBadRequest, "Badge style must be one of %v.", badge.Styles)
+			return
+		}
 		// convert parameter into int
 		challid_str := c.Params.ByName("challid")
 		challid, err := strconv.Atoi(challid_str)
@@ -88,28 +287,288 @@ func main() {
 			return
 		}
 
-		// fetch record
-		badge_url, err := badger.GetBadge(challid)
+		// fetch record and render badge
+		svg, err := badger.GetBadgeSvg(challid, style)
 		if err != nil {
+			if errors.Is(err, badge.ErrStatusNotFound) {
+				serve_svg(c, http.StatusNotFound, func() ([]byte, error) { return badge.ErrorBadgeSvg("status not found", style) })
+				return
+			}
 			logger.Warnf("%v", err)
-			c.String(http.StatusInternalServerError, "Something went to bad when fetching test result for %d.", challid)
+			serve_svg(c, http.StatusInternalServerError, func() ([]byte, error) { return badge.ErrorBadgeSvg("status fetching fails", style) })
 			return
 		}
+		serve_svg(c, http.StatusOK, func() ([]byte, error) { return svg, nil })
+	})
 
-		c.Header("Cache-Control", "max-age=60, public, immutable, must-revalidate")
-		c.Redirect(http.StatusFound, badge_url)
-		return
+	// badge EP in shields.io endpoint schema
+	server.GET("/badge/:challid/json", func(c *gin.Context) {
+		challid_str := c.Params.ByName("challid")
+		challid, err := strconv.Atoi(challid_str)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, badge.ErrorBadgeEndpoint("invalid challenge ID"))
+			return
+		}
+
+		endpoint, err := badger.GetBadgeEndpoint(challid)
+		if err != nil {
+			if errors.Is(err, badge.ErrStatusNotFound) {
+				c.JSON(http.StatusNotFound, badge.ErrorBadgeEndpoint("status not found"))
+				return
+			}
+			logger.Warnf("%v", err)
+			c.JSON(http.StatusInternalServerError, badge.ErrorBadgeEndpoint("status fetching fails"))
+			return
+		}
+		c.Header("Cache-Control", "max-age=60, public, must-revalidate")
+		c.JSON(http.StatusOK, endpoint)
 	})
 
 	// default error badge
 	server.GET("/badge/error", func(c *gin.Context) {
-		c.Header("Cache-Control", "max-age=60, public, immutable, must-revalidate")
-		c.Redirect(http.StatusFound, "https://img.shields.io/badge/error-status_fetching_fails-red")
+		style := c.DefaultQuery("style", "flat")
+		serve_svg(c, http.StatusOK, func() ([]byte, error) { return badge.ErrorBadgeSvg("status fetching fails", style) })
+	})
+
+	// solver outputs EP
+	// outputs may contain secrets printed by solvers, so they are served only to holders of the token
+	server.GET("/results/:challid/:runid/log", func(c *gin.Context) {
+		if len(opts.log_dir) == 0 || len(opts.log_token) == 0 {
+			c.String(http.StatusNotFound, "Solver outputs are not served.")
+			return
+		}
+		if !has_bearer_token(c, opts.log_token) {
+			c.Header("WWW-Authenticate", `Bearer realm="solver outputs"`)
+			c.String(http.StatusUnauthorized, "Token is required to read solver outputs.")
+			return
+		}
+
+		challid_str := c.Params.ByName("challid")
+		challid, err := strconv.Atoi(challid_str)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Specified challenge ID is invalid: %s.", challid_str)
+			return
+		}
+		runid := c.Params.ByName("runid")
+		if !checker.IsValidRunId(runid) {
+			c.String(http.StatusBadRequest, "Specified run ID is invalid: %s.", runid)
+			return
+		}
+		log, err := checker.ReadRunLog(opts.log_dir, challid, runid)
+		if err != nil {
+			if os.IsNotExist(err) {
+				c.String(http.StatusNotFound, "Log of run %s for %d not found.", runid, challid)
+			} else {
+				logger.Warnf("%v", err)
+				c.String(http.StatusInternalServerError, "Something went to bad when reading log of run %s for %d.", runid, challid)
+			}
+			return
+		}
+
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", log)
+	})
+
+	// test results EP
+	server.GET("/api/v1/results/:challid", func(c *gin.Context) {
+		challid_str := c.Params.ByName("challid")
+		challid, err := strconv.Atoi(challid_str)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Specified challenge ID is invalid: %s.", challid_str)
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultResultsLimit)))
+		if err != nil || limit <= 0 || limit > maxResultsLimit {
+			c.String(http.StatusBadRequest, "Limit must be between 1 and %d.", maxResultsLimit)
+			return
+		}
+
+		results, err := store.FetchResult(challid, limit)
+		if err != nil {
+			logger.Warnf("%v", err)
+			c.String(http.StatusInternalServerError, "Something went to bad when fetching test results for %d.", challid)
+			return
+		}
+		if results == nil {
+			results = []checker.DbResult{}
+		}
+		c.JSON(http.StatusOK, results)
+	})
+
+	// challenge inventory EP
+	server.GET("/api/v1/challenges", func(c *gin.Context) {
+		latest, err := store.FetchLatestResults()
+		if err != nil {
+			logger.Warnf("%v", err)
+			c.String(http.StatusInternalServerError, "Something went to bad when fetching challenges.")
+			return
+		}
+		challenges := make([]challenge_summary, 0, len(latest))
+		for _, result := range latest {
+			challenges = append(challenges, challenge_summary{
+				Id:          result.ChallId,
+				Name:        result.Name,
+				Category:    result.Category,
+				Result:      result.Result,
+				Status:      result.Result.ToMessage(),
+				LastChecked: result.Timestamp,
+				RunId:       result.RunId,
+			})
+		}
+		c.JSON(http.StatusOK, challenges)
+	})
+
+	// paginated history of a challenge EP
+	server.GET("/api/v1/challenges/:challid/results", func(c *gin.Context) {
+		challid_str := c.Params.ByName("challid")
+		challid, err := strconv.Atoi(challid_str)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Specified challenge ID is invalid: %s.", challid_str)
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultResultsLimit)))
+		if err != nil || limit <= 0 || limit > maxResultsLimit {
+			c.String(http.StatusBadRequest, "Limit must be between 1 and %d.", maxResultsLimit)
+			return
+		}
+		// whole history by default
+		since, err := parse_time(c.Query("since"), time.Now(), time.Time{})
+		if err != nil {
+			c.String(http.StatusBadRequest, "%v", err)
+			return
+		}
+		// ID of the last result of the previous page, which breaks ties of results at `since`
+		after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+		if err != nil || after < 0 {
+			c.String(http.StatusBadRequest, "Specified result ID is invalid: %s.", c.Query("after"))
+			return
+		}
+
+		results, err := store.FetchResultsSince(challid, since, after, limit)
+		if err != nil {
+			logger.Warnf("%v", err)
+			c.String(http.StatusInternalServerError, "Something went to bad when fetching test results for %d.", challid)
+			return
+		}
+		page := results_page{ChallId: challid, Results: results}
+		if page.Results == nil {
+			page.Results = []checker.DbResult{}
+		}
+		if len(results) == limit {
+			// timestamps of MySQL are in seconds, so several results can share the last timestamp
+			last := results[len(results)-1]
+			page.NextSince = &last.Timestamp
+			page.NextAfter = last.Id
+		}
+		c.JSON(http.StatusOK, page)
+	})
+
+	// results of a run EP
+	server.GET("/api/v1/runs/:runid", func(c *gin.Context) {
+		runid := c.Params.ByName("runid")
+		if !checker.IsValidRunId(runid) {
+			c.String(http.StatusBadRequest, "Specified run ID is invalid: %s.", runid)
+			return
+		}
+
+		results, err := store.FetchRun(runid)
+		if err != nil {
+			logger.Warnf("%v", err)
+			c.String(http.StatusInternalServerError, "Something went to bad when fetching results of run %s.", runid)
+			return
+		}
+		if len(results) == 0 {
+			c.String(http.StatusNotFound, "Run %s not found.", runid)
+			return
+		}
+		c.JSON(http.StatusOK, results)
+	})
+
+	// event stream EP
+	server.GET("/api/v1/events", func(c *gin.Context) {
+		events, unsubscribe := hub.Subscribe()
+		defer unsubscribe()
+		keep_alive := time.NewTicker(keepAliveInterval)
+		defer keep_alive.Stop()
+
+		c.Header("Cache-Control", "no-cache")
+		// disable buffering of reverse proxy (nginx)
+		c.Header("X-Accel-Buffering", "no")
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case event, ok := <-events:
+				if !ok {
+					return false
+				}
+				c.SSEvent(event.Type, event)
+				return true
+			case <-keep_alive.C:
+				_, err := io.WriteString(w, ": keep-alive\n\n")
+				return err == nil
+			}
+		})
+	})
+
+	// availability statistics EP
+	server.GET("/api/v1/stats/:challid", func(c *gin.Context) {
+		challid_str := c.Params.ByName("challid")
+		challid, err := strconv.Atoi(challid_str)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Specified challenge ID is invalid: %s.", challid_str)
+			return
+		}
+		since, until, err := parse_window(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		availability, err := checker.ComputeAvailability(store, challid, since, until)
+		if err != nil {
+			if errors.Is(err, checker.ErrChallengeNotFound) {
+				c.String(http.StatusNotFound, "Challenge %d not found.", challid)
+				return
+			}
+			logger.Warnf("%v", err)
+			c.String(http.StatusInternalServerError, "Something went to bad when computing statistics for %d.", challid)
+			return
+		}
+		c.JSON(http.StatusOK, availability)
+	})
+
+	// availability statistics of all challenges EP
+	server.GET("/api/v1/stats", func(c *gin.Context) {
+		since, until, err := parse_window(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "%v", err)
+			return
+		}
+
+		latest, err := store.FetchLatestResults()
+		if err != nil {
+			logger.Warnf("%v", err)
+			c.String(http.StatusInternalServerError, "Something went to bad when fetching challenges.")
+			return
+		}
+		stats := make([]checker.Availability, 0, len(latest))
+		for _, result := range latest {
+			availability, err := checker.ComputeAvailability(store, result.ChallId, since, until)
+			if err != nil {
+				logger.Warnf("%v", err)
+				c.String(http.StatusInternalServerError, "Something went to bad when computing statistics for %d.", result.ChallId)
+				return
+			}
+			if len(availability.Name) == 0 {
+				availability.Name = result.Name
+			}
+			stats = append(stats, availability)
+		}
+		c.JSON(http.StatusOK, stats)
 	})
 
 	// Run server
-	port := get_port()
-	port_str := fmt.Sprintf(":%v", port)
+	port_str := fmt.Sprintf(":%v", opts.port)
 	logger.Infof("Badge server running on %s.", port_str)
 	server.Run(port_str)
 }